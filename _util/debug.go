@@ -33,12 +33,12 @@ const (
     MH_Debug = 0x100 | iota
 )
 
+func init() {
+	mlst.RegisterSchema(MH_Debug,mlst.Schema{Name:"MH_Debug"})
+}
+
 func dbg(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) bool {
-	for {
-		v,e := d.DecodeInterface()
-		if e!=nil { break }
-		fmt.Println("[DEBUG]>",v)
-	}
+	fmt.Println("[DEBUG]>",mlst.Describe(msg.Bytes()))
 	return false
 }
 
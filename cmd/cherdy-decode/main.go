@@ -0,0 +1,105 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+Decodes messages into human-readable form.
+
+Usage:
+
+	cherdy-decode [-format auto|hex|base64] [packet ...]
+	cherdy-decode -tap recording
+
+Packets are given as arguments or as lines on stdin. With -tap, a wire tap
+recording is printed.
+*/
+package main
+
+import (
+	"github.com/byte-mug/cherdy/mlst"
+	_ "github.com/byte-mug/cherdy/db"
+	_ "github.com/byte-mug/cherdy/xhashring"
+	
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+var format = flag.String("format","auto","Packet encoding: auto, hex or base64")
+var tap = flag.String("tap","","Print a wire tap recording")
+
+func decode(s string) ([]byte,error) {
+	s = strings.TrimSpace(s)
+	switch *format {
+	case "hex": return hex.DecodeString(s)
+	case "base64": return base64.StdEncoding.DecodeString(s)
+	}
+	if b,err := hex.DecodeString(s); err==nil { return b,nil }
+	if b,err := base64.StdEncoding.DecodeString(s); err==nil { return b,nil }
+	return base64.RawStdEncoding.DecodeString(s)
+}
+
+func packet(s string) {
+	if strings.TrimSpace(s)=="" { return }
+	b,err := decode(s)
+	if err!=nil {
+		fmt.Println("<undecodable>",err)
+		return
+	}
+	fmt.Println(mlst.Describe(b))
+}
+
+func dumpTap(name string) {
+	f,err := os.Open(name)
+	if err!=nil { log.Fatal(err) }
+	defer f.Close()
+	tr,err := mlst.NewTapReader(f)
+	if err!=nil { log.Fatal(err) }
+	for {
+		rec,err := tr.Next()
+		if err==io.EOF { return }
+		if err!=nil { log.Fatal(err) }
+		fmt.Println(rec)
+	}
+}
+
+func main() {
+	flag.Parse()
+	if *tap!="" {
+		dumpTap(*tap)
+		return
+	}
+	if flag.NArg()!=0 {
+		for _,a := range flag.Args() { packet(a) }
+		return
+	}
+	sc := bufio.NewScanner(os.Stdin)
+	sc.Buffer(nil,1<<24)
+	for sc.Scan() { packet(sc.Text()) }
+}
+
@@ -0,0 +1,447 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package db
+
+import (
+	"github.com/dgraph-io/badger"
+	"github.com/byte-mug/cherdy/mlst"
+	"github.com/byte-mug/golibs/bufferex"
+	"github.com/hashicorp/memberlist"
+	
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+/*
+Anti-entropy compares the replicas of each ownership range (see Ring.KeyRange) with
+the other owners and exchanges the keys, that differ. The newest version wins.
+
+Every range has a hash tree: the keys are distributed over aeBuckets buckets, each
+leaf is the hash of the (key, version, tombstone) triples of it's bucket and the root
+is the hash of all leaves. Tombstones take part, so deletes converge like writes.
+
+	MH_AESync, range, root, leaves, target, targid
+	MH_AESyncResponse, targid, RESP_OK, buckets, count, (key, version, tombstone)*count
+	MH_AEPull, count, key*count, target
+
+The receiver of MH_AESync responds with the buckets, that differ from it's own tree,
+and the digest of it's keys in these buckets. The initiator pushes the keys, where
+it has the newer version, as META_Versioned or META_Tombstone MH_Put, and pulls the
+others using MH_AEPull. A tombstone wins over a value of the same version. Keys are
+sent with the hashnum from Ring.KeyHashnum, not with the shard, they are stored in.
+
+The trees and digests of all ranges are built by a single walk over the keyspace and
+reused for Replication.TreeAge.
+*/
+
+const (
+	aeBuckets = 256
+	
+	// How long hash trees are reused. Default of Replication.TreeAge.
+	DefaultTreeAge = time.Second*10
+)
+
+type merkle struct{
+	leaves [aeBuckets][]byte // nil, if the bucket is empty.
+	root   []byte
+}
+
+type merkleBuilder [aeBuckets]hash.Hash
+
+func aeBucket(key []byte) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32()%aeBuckets)
+}
+
+func (b *merkleBuilder) add(key []byte, e aeEntry) {
+	i := aeBucket(key)
+	if b[i]==nil { b[i] = sha256.New() }
+	var n [9]byte
+	binary.BigEndian.PutUint32(n[:4],uint32(len(key)))
+	b[i].Write(n[:4])
+	b[i].Write(key)
+	binary.BigEndian.PutUint64(n[:8],e.version)
+	if e.tomb { n[8] = 1 }
+	b[i].Write(n[:])
+}
+func (b *merkleBuilder) finish() *merkle {
+	t := new(merkle)
+	h := sha256.New()
+	for i,l := range b {
+		if l!=nil { t.leaves[i] = l.Sum(nil) }
+		h.Write([]byte{byte(len(t.leaves[i]))})
+		h.Write(t.leaves[i])
+	}
+	t.root = h.Sum(nil)
+	return t
+}
+
+/*
+The version of a key on a replica.
+*/
+type aeEntry struct{
+	version uint64
+	tomb    bool // The key is deleted.
+}
+
+/*
+Returns true, if e supersedes o. A tombstone wins over a value of the same version.
+*/
+func (e aeEntry) newer(o aeEntry) bool {
+	return e.version>o.version || (e.version==o.version && e.tomb && !o.tomb)
+}
+
+/*
+Returns the version of the item without copying it's value. Like itemValue, entries
+without a stored version report 0.
+*/
+func itemVersion(item *badger.Item) (version uint64,err error) {
+	switch item.UserMeta() {
+	case META_Versioned,META_Tombstone: break
+	default: return 0,nil
+	}
+	err = item.Value(func(b []byte) (e error) {
+		if item.UserMeta()==META_Tombstone {
+			version,e = tombVersion(b)
+		} else {
+			version,_,e = unversion(b)
+		}
+		return
+	})
+	return
+}
+
+func hasOwner(owners []string, name string) bool {
+	for _,o := range owners {
+		if o==name { return true }
+	}
+	return false
+}
+
+/*
+Calls fn for every local key and tombstone, that belongs to a range, owned by self.
+*/
+func (s *Store) aeWalk(self string, fn func(rng string, owners []string, key []byte, e aeEntry)) error {
+	m := s.newScan(nil,nil,nil)
+	m.tombs = true
+	defer m.Close()
+	for item := m.Next(); item!=nil; item = m.Next() {
+		// Redirects are local bookkeeping, not replicated data.
+		if item.UserMeta()!=META_OuterRedirect {
+			key := item.KeyCopy(nil)
+			rng,owners := s.Repl.Ring.KeyRange(key)
+			if hasOwner(owners,self) {
+				version,err := itemVersion(item)
+				if err!=nil { return err }
+				fn(rng,owners,key,aeEntry{version,item.UserMeta()==META_Tombstone})
+			}
+		}
+		m.Advance()
+	}
+	return nil
+}
+
+/*
+The hash tree and the digest of one range.
+*/
+type aeRange struct{
+	owners  []string
+	tree    *merkle
+	buckets [aeBuckets]map[string]aeEntry
+}
+
+type antiEntropy struct{
+	lck    sync.Mutex
+	built  time.Time
+	ranges map[string]*aeRange
+}
+
+/*
+Returns the hash trees and digests of all ranges, that have local keys. They are
+built by one walk and reused for Replication.TreeAge. The result must not be
+modified.
+*/
+func (s *Store) aeRanges(self string) (map[string]*aeRange,error) {
+	ae := &s.ae
+	ae.lck.Lock()
+	defer ae.lck.Unlock()
+	age := s.Repl.TreeAge
+	if age<=0 { age = DefaultTreeAge }
+	if ae.ranges!=nil && time.Since(ae.built)<age { return ae.ranges,nil }
+	
+	bs := make(map[string]*merkleBuilder)
+	rs := make(map[string]*aeRange)
+	err := s.aeWalk(self,func(rng string, os []string, key []byte, e aeEntry) {
+		r := rs[rng]
+		if r==nil {
+			r = &aeRange{owners:os}
+			rs[rng] = r
+			bs[rng] = new(merkleBuilder)
+		}
+		bs[rng].add(key,e)
+		i := aeBucket(key)
+		if r.buckets[i]==nil { r.buckets[i] = make(map[string]aeEntry) }
+		r.buckets[i][string(key)] = e
+	})
+	if err!=nil { return nil,err }
+	
+	for rng,b := range bs { rs[rng].tree = b.finish() }
+	ae.ranges,ae.built = rs,time.Now()
+	return rs,nil
+}
+
+/*
+Returns the versions of the local keys of the given buckets.
+*/
+func (r *aeRange) digest(buckets map[int]bool) map[string]aeEntry {
+	es := make(map[string]aeEntry)
+	if r==nil { return es }
+	for b := range buckets {
+		for k,e := range r.buckets[b] { es[k] = e }
+	}
+	return es
+}
+
+/*
+Sends the current local entries of the keys to node as META_Versioned or
+META_Tombstone puts.
+*/
+func (s *Store) aePush(w *mlst.WrapNode, node *memberlist.Node, keys [][]byte) {
+	c := make(txnCache)
+	defer c.discard()
+	for _,key := range keys {
+		hashnum := s.Repl.Ring.KeyHashnum(key)
+		_,item,err := s.lookup(c,hashnum,key)
+		if err!=nil { continue }
+		meta := byte(META_Versioned)
+		switch item.UserMeta() {
+		case META_OuterRedirect: continue
+		case META_Tombstone: meta = META_Tombstone
+		}
+		value,version,err := itemValue(item)
+		if err!=nil {
+			ioError(w,"anti-entropy")
+			continue
+		}
+		// The acknowledgement is discarded by the CallTable.
+		mb := w.NewMessage()
+		mb.EncodeMulti(MH_Put,hashnum,meta,item.ExpiresAt(),key,versioned(version,value),w.Name,uint64(0))
+		if w.SendTo(mlst.ST_BestFit,node,mb.Bytes())==nil {
+			w.Metrics.Counter("cherdy_db_antientropy_keys_total","Keys, sent by anti-entropy.").Inc()
+		}
+	}
+}
+
+func (s *Store) i_AESync(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) {
+	defer d.Release(msg)
+	rng,err := d.DecodeString()
+	if err!=nil { w.Log.Debug("malformed MH_AESync","err",err); return }
+	
+	root,err := d.DecodeBytes()
+	if err!=nil { w.Log.Debug("malformed MH_AESync","err",err); return }
+	
+	var leaves [aeBuckets][]byte
+	n,err := d.DecodeArrayLen()
+	if err==nil && n!=aeBuckets { err = ErrBadCount }
+	if err!=nil { w.Log.Debug("malformed MH_AESync","err",err); return }
+	for i := range leaves {
+		leaves[i],err = d.DecodeBytes()
+		if err!=nil { w.Log.Debug("malformed MH_AESync","err",err); return }
+	}
+	
+	target,err := d.DecodeString()
+	if err!=nil { w.Log.Debug("malformed MH_AESync","err",err); return }
+	
+	targid,err := d.DecodeUint64()
+	if err!=nil { w.Log.Debug("malformed MH_AESync","err",err); return }
+	
+	if s.Repl.Ring==nil { return }
+	
+	rs,err := s.aeRanges(w.Name)
+	if err!=nil {
+		w.Log.Error("anti-entropy failed","err",err)
+		ioError(w,"anti-entropy")
+		s.i_Respond(w,MH_AESyncResponse,target,targid,RESP_IoError,unwrapCause(err).Error())
+		return
+	}
+	r := rs[rng]
+	t := new(merkle)
+	if r!=nil { t = r.tree }
+	
+	buckets := make(map[int]bool)
+	if !bytes.Equal(root,t.root) {
+		for i := range leaves {
+			if !bytes.Equal(leaves[i],t.leaves[i]) { buckets[i] = true }
+		}
+	}
+	es := r.digest(buckets)
+	
+	bl := make([]int,0,len(buckets))
+	for b := range buckets { bl = append(bl,b) }
+	add := []interface{}{bl,len(es)}
+	for k,e := range es { add = append(add,[]byte(k),e.version,e.tomb) }
+	s.i_Respond(w,MH_AESyncResponse,target,targid,RESP_OK,add...)
+}
+func (s *Store) AESync(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) bool {
+	mlst.RetainBinary(d)
+	go s.i_AESync(w,d,msg)
+	return false
+}
+
+func (s *Store) i_AEPull(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) {
+	defer d.Release(msg)
+	n,err := decodeCount(d)
+	if err!=nil { w.Log.Debug("malformed MH_AEPull","err",err); return }
+	
+	keys := make([][]byte,n)
+	for i := range keys {
+		keys[i],err = d.DecodeBytes()
+		if err!=nil { w.Log.Debug("malformed MH_AEPull","err",err); return }
+	}
+	
+	target,err := d.DecodeString()
+	if err!=nil { w.Log.Debug("malformed MH_AEPull","err",err); return }
+	
+	node := w.Lookup(target)
+	if node==nil || s.Repl.Ring==nil { return }
+	s.aePush(w,node,keys)
+}
+func (s *Store) AEPull(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) bool {
+	mlst.RetainBinary(d)
+	go s.i_AEPull(w,d,msg)
+	return false
+}
+
+/*
+Synchronizes a range with one peer.
+*/
+func (s *Store) aeSync(w *mlst.WrapNode, node *memberlist.Node, rng string, r *aeRange) {
+	t := r.tree
+	var buckets map[int]bool
+	var theirs map[string]aeEntry
+	ok := gather(w,[]*memberlist.Node{node},1,s.Repl.timeout(context.Background()),func(id uint64) []byte {
+		mb := w.NewMessage()
+		mb.EncodeMulti(MH_AESync,rng,t.root)
+		mb.EncodeArrayLen(aeBuckets)
+		for _,l := range t.leaves { mb.EncodeBytes(l) }
+		mb.EncodeMulti(w.Name,id)
+		return mb.Bytes()
+	},func(i int, r *mlst.Reply) bool {
+		resp,err := r.DecodeInt()
+		if err!=nil || resp!=RESP_OK { return false }
+		var bl []int
+		if err = r.Decode(&bl); err!=nil { return false }
+		n,err := decodeCount(r.MessageReader)
+		if err!=nil { return false }
+		buckets = make(map[int]bool,len(bl))
+		for _,b := range bl { buckets[b] = true }
+		theirs = make(map[string]aeEntry,n)
+		for j := 0; j<n; j++ {
+			var key []byte
+			var e aeEntry
+			if err = r.DecodeMulti(&key,&e.version,&e.tomb); err!=nil { return false }
+			theirs[string(key)] = e
+		}
+		return true
+	},nil)
+	if ok==0 {
+		w.Log.Debug("anti-entropy sync failed","range",rng,"peer",node.Name)
+		return
+	}
+	if len(buckets)==0 {
+		w.Metrics.Counter("cherdy_db_antientropy_syncs_total","Range synchronizations by result.","result","in-sync").Inc()
+		return
+	}
+	w.Metrics.Counter("cherdy_db_antientropy_syncs_total","Range synchronizations by result.","result","diverged").Inc()
+	
+	mine := r.digest(buckets)
+	var push [][]byte
+	for k,e := range mine {
+		if o,ok := theirs[k]; !ok || e.newer(o) { push = append(push,[]byte(k)) }
+	}
+	var pull []interface{}
+	for k,o := range theirs {
+		if e,ok := mine[k]; !ok || o.newer(e) { pull = append(pull,[]byte(k)) }
+	}
+	w.Log.Debug("anti-entropy diverged","range",rng,"peer",node.Name,"push",len(push),"pull",len(pull))
+	
+	s.aePush(w,node,push)
+	if len(pull)!=0 {
+		mb := w.NewMessage()
+		mb.EncodeMulti(MH_AEPull,len(pull))
+		mb.EncodeMulti(pull...)
+		mb.EncodeString(w.Name)
+		w.SendTo(mlst.ST_BestFit,node,mb.Bytes())
+	}
+}
+
+/*
+Runs one anti-entropy round: every range with local keys is synchronized with all
+other alive owners.
+*/
+func (s *Store) AntiEntropy(w *mlst.WrapNode) error {
+	if s.Repl.Ring==nil { return nil }
+	rs,err := s.aeRanges(w.Name)
+	if err!=nil { return err }
+	for rng,r := range rs {
+		for _,o := range r.owners {
+			if o==w.Name { continue }
+			node := w.Lookup(o)
+			if node==nil { continue }
+			s.aeSync(w,node,rng,r)
+		}
+	}
+	return nil
+}
+
+/*
+Runs AntiEntropy every interval. Call the returned function to stop it.
+*/
+func (s *Store) StartAntiEntropy(w *mlst.WrapNode, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var once sync.Once
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done: return
+			case <-t.C:
+			}
+			if err := s.AntiEntropy(w); err!=nil {
+				w.Log.Error("anti-entropy failed","err",err)
+				ioError(w,"anti-entropy")
+			}
+		}
+	}()
+	return func() { once.Do(func() { close(done) }) }
+}
+
@@ -0,0 +1,83 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+/*
+Only node-0 sees the delete. Anti-entropy brings it to the other replica, which has
+the older value.
+*/
+func TestAntiEntropyDelete(t *testing.T) {
+	c,ss := stores(t,2,2)
+	for _,s := range ss {
+		s.Repl.RepairRate = -1
+		s.Repl.TreeAge = time.Millisecond
+	}
+	w := c.Nodes[0]
+	k := []byte("key")
+	hashnum := staticRing(nil).KeyHashnum(k)
+	for _,nd := range c.Nodes {
+		expect(t,call(t,w,nd.Name,MH_Put,hashnum,META_Versioned,0,k,versioned(10,[]byte("a"))),"[0]")
+	}
+	expect(t,call(t,w,"node-0",MH_Put,hashnum,META_Tombstone,0,k,versioned(20,nil)),"[0]")
+	expect(t,call(t,w,"node-0",MH_ReplGet,k,CL_All),"[1 2 true]")
+	
+	if err := ss[0].AntiEntropy(w); err!=nil { t.Fatal(err) }
+	converge(t,c,k,2,"[5 20 ")
+	expect(t,call(t,w,"node-0",MH_ReplGet,k,CL_All),"[1 2 false]")
+}
+
+/*
+The initiator pulls newer entries and pushes its own ones.
+*/
+func TestAntiEntropyExchange(t *testing.T) {
+	c,ss := stores(t,3,3)
+	for _,s := range ss {
+		s.Repl.RepairRate = -1
+		s.Repl.TreeAge = time.Millisecond
+	}
+	w := c.Nodes[0]
+	put := func(node, key, value string, version uint64) {
+		hashnum := staticRing(nil).KeyHashnum([]byte(key))
+		expect(t,call(t,w,node,MH_Put,hashnum,META_Versioned,0,[]byte(key),versioned(version,[]byte(value))),"[0]")
+	}
+	put("node-0","mine","a",10)
+	put("node-1","theirs","b",10)
+	put("node-0","both","old",10)
+	put("node-2","both","new",20)
+	
+	// The first round pulls the newer entries to node-0, the second one pushes them
+	// to the owners, that don't have them yet.
+	for r := 0; r<2; r++ {
+		if err := ss[0].AntiEntropy(w); err!=nil { t.Fatal(err) }
+		time.Sleep(time.Millisecond*200)
+	}
+	converge(t,c,[]byte("mine"),3,"[0 a 10 ")
+	converge(t,c,[]byte("theirs"),3,"[0 b 10 ")
+	converge(t,c,[]byte("both"),3,"[0 new 20 ")
+}
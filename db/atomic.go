@@ -0,0 +1,252 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package db
+
+import (
+	"github.com/dgraph-io/badger"
+	"github.com/byte-mug/cherdy/mlst"
+	"github.com/byte-mug/golibs/bufferex"
+	
+	"bytes"
+	gerrors "errors"
+	"github.com/vmihailenco/msgpack"
+	"math"
+	"sort"
+)
+
+/*
+Atomic operations on a single key:
+
+	MH_Update, hashnum, op, arg, expiresAt, key, target, targid
+	MH_UpdateResponse, targid, resp, result, version
+
+Counters are stored as msgpack-encoded int64, sets as msgpack-encoded, sorted
+arrays of byte strings. A missing key counts as 0, empty value or empty set.
+*/
+const (
+	OP_Incr   = 1+iota // arg: int64 delta. Result: the new value.
+	OP_Decr            // arg: int64 delta. Result: the new value.
+	OP_Append          // arg: bytes. Result: the new length.
+	OP_SetAdd          // arg: bytes. Result: true, if the member has been added.
+)
+
+// How often an update is retried, if it's transaction conflicts with another one.
+const updateRetries = 8
+
+var (
+	ErrTypeMismatch = gerrors.New("Value has the wrong type")
+	ErrOverflow = gerrors.New("Integer overflow")
+)
+
+func opResp(err error) int {
+	switch err {
+	case ErrTypeMismatch: return RESP_TypeMismatch
+	case ErrOverflow: return RESP_Overflow
+	case ErrIllegal: return RESP_Illegal
+	}
+	return RESP_IoError
+}
+
+/*
+Decodes b into v. Trailing bytes mean, that b is not a single value of that type.
+*/
+func unmarshalExact(b []byte, v interface{}) error {
+	r := bytes.NewReader(b)
+	if err := msgpack.NewDecoder(r).Decode(v); err!=nil { return err }
+	if r.Len()!=0 { return ErrTypeMismatch }
+	return nil
+}
+
+/*
+Computes the new value. exists is false, if the key is missing.
+*/
+func applyOp(op int, delta int64, arg, cur []byte, exists bool) (nv []byte, result interface{}, err error) {
+	switch op {
+	case OP_Decr:
+		if delta==math.MinInt64 { return nil,nil,ErrOverflow }
+		delta = -delta
+		fallthrough
+	case OP_Incr:
+		var n int64
+		if exists {
+			if err = unmarshalExact(cur,&n); err!=nil { return nil,nil,ErrTypeMismatch }
+		}
+		if (delta>0 && n>math.MaxInt64-delta) || (delta<0 && n<math.MinInt64-delta) { return nil,nil,ErrOverflow }
+		n += delta
+		nv,err = msgpack.Marshal(n)
+		return nv,n,err
+	case OP_Append:
+		nv = append(cur,arg...)
+		return nv,len(nv),nil
+	case OP_SetAdd:
+		var set [][]byte
+		if exists {
+			if err = unmarshalExact(cur,&set); err!=nil { return nil,nil,ErrTypeMismatch }
+		}
+		i := sort.Search(len(set),func(i int) bool { return bytes.Compare(set[i],arg)>=0 })
+		if i<len(set) && bytes.Equal(set[i],arg) { return nil,false,nil } // Already a member.
+		set = append(set,nil)
+		copy(set[i+1:],set[i:])
+		set[i] = arg
+		nv,err = msgpack.Marshal(set)
+		return nv,true,err
+	}
+	return nil,nil,ErrIllegal
+}
+
+/*
+Reads, modifies and writes key inside a single update transaction on db. If f returns
+a nil value, nothing is written. The new version is higher than floor, e.g. the
+version of a tombstone in another shard.
+*/
+func db_update(db *badger.DB, key []byte, expiresAt, floor uint64, f func(cur []byte, exists bool) ([]byte,error)) (version uint64, err error) {
+	for try := 0; try<updateRetries; try++ {
+		err = db.Update(func(tx *badger.Txn) error {
+			var cur []byte
+			cv := floor
+			exists := false
+			item,err := tx.Get(key)
+			switch {
+			case err==badger.ErrKeyNotFound: break
+			case err!=nil: return err
+			case item.UserMeta()==META_Tombstone:
+				var tv uint64
+				if _,tv,err = itemValue(item); err!=nil { return err }
+				if tv>cv { cv = tv }
+			default:
+				cur,cv,err = itemValue(item)
+				if err!=nil { return err }
+				exists = true
+			}
+			nv,err := f(cur,exists)
+			if err!=nil || nv==nil {
+				version = cv
+				if !exists { version = 0 }
+				return err
+			}
+			version = nextVersion(cv)
+			return tx.SetEntry(&badger.Entry{Key:key,Value:versioned(version,nv),UserMeta:META_Versioned,ExpiresAt:expiresAt})
+		})
+		if err!=badger.ErrConflict { return }
+	}
+	return
+}
+
+func (s *Store) i_Update(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) {
+	defer d.Release(msg)
+	hashnum,err := d.DecodeInt()
+	if err!=nil { w.Log.Debug("malformed MH_Update","err",err); return }
+	
+	op,err := d.DecodeInt()
+	if err!=nil { w.Log.Debug("malformed MH_Update","err",err); return }
+	
+	var delta int64
+	var arg []byte
+	switch op {
+	case OP_Incr,OP_Decr: delta,err = d.DecodeInt64()
+	case OP_Append,OP_SetAdd: arg,err = d.DecodeBytes()
+	default: err = d.Skip()
+	}
+	if err!=nil { w.Log.Debug("malformed MH_Update","err",err); return }
+	
+	expiresAt,err := d.DecodeUint64()
+	if err!=nil { w.Log.Debug("malformed MH_Update","err",err); return }
+	
+	key,err := d.DecodeBytes()
+	if err!=nil { w.Log.Debug("malformed MH_Update","err",err); return }
+	
+	target,err := d.DecodeString()
+	if err!=nil { w.Log.Debug("malformed MH_Update","err",err); return }
+	
+	targid,err := d.DecodeUint64()
+	if err!=nil { w.Log.Debug("malformed MH_Update","err",err); return }
+	
+	switch op {
+	case OP_Incr,OP_Decr,OP_Append,OP_SetAdd: break
+	default:
+		w.Log.Debug("update rejected","reason","illegal-op","op",op,"key",key)
+		s.i_Respond(w,MH_UpdateResponse,target,targid,RESP_Illegal)
+		return
+	}
+	
+	sp := w.Tracer.Start(d,"db update")
+	if sp!=nil { sp.SetAttr("op",op) }
+	defer sp.Finish()
+	
+	// The stripe lock keeps the key from moving between shards during the update.
+	m := s.klck.lock(key)
+	defer m.Unlock()
+	
+	cur,err := s.current(hashnum,key)
+	if err!=nil {
+		w.Log.Error("update failed","key",key,"err",err)
+		ioError(w,"update")
+		s.i_Respond(w,MH_UpdateResponse,target,targid,RESP_IoError,unwrapCause(err).Error())
+		return
+	}
+	if cur.redir!="" {
+		s.i_Respond(w,MH_UpdateResponse,target,targid,RESP_Redirect,cur.redir)
+		return
+	}
+	
+	db := cur.db
+	var pl placement
+	if db==nil {
+		ok := false
+		pl,ok = s.place(hashnum,true,&badger.Entry{Key:key,Value:arg})
+		if !ok {
+			w.Metrics.Counter("cherdy_db_no_space_total","Puts, rejected because no shard had free space.").Inc()
+			s.i_Respond(w,MH_UpdateResponse,target,targid,RESP_IoError,ErrNoSpace.Error())
+			return
+		}
+		db = pl.store
+		defer s.touch(pl)
+	}
+	
+	var result interface{}
+	version,err := db_update(db,key,expiresAt,cur.version,func(cur []byte, exists bool) (nv []byte,err error) {
+		nv,result,err = applyOp(op,delta,arg,cur,exists)
+		return
+	})
+	if err==nil && pl.hint!=nil { err = pl.hstore.Update(func(tx *badger.Txn) error { return tx.SetEntry(pl.hint) }) }
+	if err==nil && cur.deleted && cur.db==nil { err = s.untomb(hashnum,key,pl) }
+	if err!=nil {
+		resp := opResp(err)
+		if resp==RESP_IoError {
+			w.Log.Error("update failed","key",key,"err",err)
+			ioError(w,"update")
+		} else {
+			w.Log.Debug("update rejected","key",key,"err",err)
+		}
+		s.i_Respond(w,MH_UpdateResponse,target,targid,resp,unwrapCause(err).Error())
+		return
+	}
+	s.i_Respond(w,MH_UpdateResponse,target,targid,RESP_OK,result,version)
+}
+func (s *Store) Update(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) bool {
+	mlst.RetainBinary(d)
+	go s.i_Update(w,d,msg)
+	return false
+}
+
@@ -0,0 +1,87 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package db
+
+import (
+	"github.com/byte-mug/cherdy/mlst"
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestUpdate(t *testing.T) {
+	c,_ := stores(t,2,0)
+	w := c.Nodes[1]
+	update := func(op int, arg interface{}, key string) []string {
+		return fields(call(t,w,"node-0",MH_Update,1,op,arg,0,[]byte(key)))
+	}
+	result := func(r []string, want string) {
+		t.Helper()
+		if r[0]!="0" || r[1]!=want { t.Fatalf("got %v, want result %s",r,want) }
+	}
+	
+	result(update(OP_Incr,5,"n"),"5")
+	result(update(OP_Decr,7,"n"),"-2")
+	if r := update(OP_Incr,int64(math.MaxInt64),"n"); r[0]!="0" { t.Fatalf("MaxInt64-2: %v",r) }
+	if r := update(OP_Incr,int64(math.MaxInt64),"n"); r[0]!="9" { t.Fatalf("overflow: %v",r) }
+	
+	result(update(OP_Append,[]byte("ab"),"s"),"2")
+	result(update(OP_Append,[]byte("cd"),"s"),"4")
+	expect(t,call(t,w,"node-0",MH_Get,1,[]byte("s")),"[0 abcd]")
+	if r := update(OP_Incr,1,"s"); r[0]!="8" { t.Fatalf("incr on bytes: %v",r) }
+	
+	result(update(OP_SetAdd,[]byte("x"),"set"),"true")
+	result(update(OP_SetAdd,[]byte("a"),"set"),"true")
+	result(update(OP_SetAdd,[]byte("x"),"set"),"false")
+	
+	if r := update(99,nil,"n"); r[0]!="4" { t.Fatalf("illegal op: %v",r) }
+	
+	// The version grows with every update, so CondPut can be mixed in.
+	r1 := update(OP_Incr,1,"v")
+	r2 := update(OP_Incr,1,"v")
+	v1,_ := strconv.ParseUint(r1[2],10,64)
+	v2,_ := strconv.ParseUint(r2[2],10,64)
+	if v2<=v1 { t.Fatalf("versions %d, %d",v1,v2) }
+}
+
+/*
+Concurrent increments are not lost.
+*/
+func TestUpdateConcurrent(t *testing.T) {
+	c,_ := stores(t,3,0)
+	var wg sync.WaitGroup
+	for _,w := range c.Nodes[1:] {
+		for i := 0; i<4; i++ {
+			wg.Add(1)
+			go func(w *mlst.WrapNode) {
+				defer wg.Done()
+				for j := 0; j<10; j++ { call(t,w,"node-0",MH_Update,1,OP_Incr,1,0,[]byte("n")) }
+			}(w)
+		}
+	}
+	wg.Wait()
+	r := fields(call(t,c.Nodes[1],"node-0",MH_Update,1,OP_Incr,0,0,[]byte("n")))
+	if r[1]!="80" { t.Fatalf("counter = %v after 80 increments",r) }
+}
@@ -0,0 +1,327 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package db
+
+import (
+	"github.com/dgraph-io/badger"
+	"github.com/byte-mug/cherdy/mlst"
+	"github.com/byte-mug/golibs/bufferex"
+	
+	"sync"
+)
+
+/*
+Batch messages carry many keys at once:
+
+	MH_MultiGet, count, (hashnum, key)*count, target, targid
+	MH_MultiPut, count, (hashnum, meta, expiresAt, key, value)*count, target, targid
+
+Both are answered with a single response, that holds one result per key, in the
+order of the request:
+
+	MH_MultiGetResponse, targid, RESP_OK, count, (resp, payload)*count
+	MH_MultiPutResponse, targid, RESP_OK, count, (resp, payload)*count
+
+The payload is the value (RESP_OK on get), the error string (RESP_IoError), the
+node name (RESP_Redirect) or nil. Keys, that have been redirected to another
+node, are not forwarded; the client has to ask the named node itself.
+*/
+
+/*
+One read transaction per database.
+*/
+type txnCache map[*badger.DB]*badger.Txn
+
+func (c txnCache) get(db *badger.DB,key []byte) (*badger.Item,error) {
+	if db==nil { return nil,badger.ErrKeyNotFound }
+	tx := c[db]
+	if tx==nil {
+		tx = db.NewTransaction(false)
+		c[db] = tx
+	}
+	return tx.Get(key)
+}
+func (c txnCache) discard() {
+	for _,tx := range c { tx.Discard() }
+}
+
+/*
+Looks a key up, using the transactions of c. Returns the database and the item, the
+redirect chain of the key ends at.
+*/
+func (s *Store) lookup(c txnCache, hashnum int, key []byte) (db *badger.DB,item *badger.Item,err error) {
+	err = s.follow(hashnum,func(shard *badger.DB) ([]byte,bool,error) {
+		db = shard
+		item,err = c.get(db,key)
+		if err==badger.ErrKeyNotFound {
+			db = s.Redirects
+			item,err = c.get(db,key)
+		}
+		if err!=nil || item.UserMeta()!=META_InnerRedirect { return nil,false,err }
+		next,verr := item.ValueCopy(nil)
+		return next,verr==nil,verr
+	})
+	return
+}
+
+func decodeCount(d *mlst.MessageReader) (int,error) {
+	n,err := d.DecodeInt()
+	if err!=nil { return 0,err }
+	// Every element takes at least one byte.
+	if n<0 || n>d.Len() { return 0,ErrBadCount }
+	return n,nil
+}
+
+type getKey struct{
+	hashnum int
+	key     []byte
+}
+
+func (s *Store) i_MultiGet(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) {
+	defer d.Release(msg)
+	n,err := decodeCount(d)
+	if err!=nil { w.Log.Debug("malformed MH_MultiGet","err",err); return }
+	
+	keys := make([]getKey,n)
+	for i := range keys {
+		keys[i].hashnum,err = d.DecodeInt()
+		if err!=nil { w.Log.Debug("malformed MH_MultiGet","err",err); return }
+		keys[i].key,err = d.DecodeBytes()
+		if err!=nil { w.Log.Debug("malformed MH_MultiGet","err",err); return }
+	}
+	
+	target,err := d.DecodeString()
+	if err!=nil { w.Log.Debug("malformed MH_MultiGet","err",err); return }
+	
+	targid,err := d.DecodeUint64()
+	if err!=nil { w.Log.Debug("malformed MH_MultiGet","err",err); return }
+	
+	node := w.Lookup(target)
+	if node==nil {
+		w.Log.Debug("multi-get response dropped","reason","unknown-requester","target",target)
+		return
+	}
+	
+	// If the sender has already given up, don't waste I/O.
+	if d.Context().Err()!=nil {
+		w.Log.Debug("multi-get discarded","reason","deadline","count",n)
+		return
+	}
+	
+	sp := w.Tracer.Start(d,"db multi-get")
+	if sp!=nil { sp.SetAttr("count",n) }
+	defer sp.Finish()
+	
+	c := make(txnCache)
+	defer c.discard()
+	
+	mb := w.NewMessage()
+	mb.EncodeMulti(MH_MultiGetResponse,targid,RESP_OK,n)
+	for _,k := range keys {
+		_,item,ierr := s.lookup(c,k.hashnum,k.key)
+		if ierr==nil {
+			switch item.UserMeta() {
+			case META_Tombstone:
+				mb.EncodeMulti(RESP_NotFound,nil)
+				continue
+			case META_OuterRedirect:
+				var b []byte
+				if b,ierr = item.ValueCopy(nil); ierr==nil {
+					mb.EncodeMulti(RESP_Redirect,string(b))
+					continue
+				}
+			default:
+				var b []byte
+				if b,_,ierr = itemValue(item); ierr==nil {
+					mb.EncodeMulti(RESP_OK,b)
+					continue
+				}
+			}
+		}
+		if ierr==badger.ErrKeyNotFound {
+			mb.EncodeMulti(RESP_NotFound,nil)
+			continue
+		}
+		w.Log.Error("get failed","key",k.key,"err",ierr)
+		ioError(w,"multi-get")
+		mb.EncodeMulti(RESP_IoError,unwrapCause(ierr).Error())
+	}
+	
+	w.SendTo(mlst.ST_BestFit,node,mb.Bytes())
+}
+func (s *Store) MultiGet(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) bool {
+	mlst.RetainBinary(d)
+	go s.i_MultiGet(w,d,msg)
+	return false
+}
+
+/*
+Collects the entries of a batch into one write transaction per database.
+*/
+type batchWriter struct{
+	wg   sync.WaitGroup
+	lck  sync.Mutex
+	errs []error
+	txns map[*badger.DB]*batchTxn
+}
+type batchTxn struct{
+	tx  *badger.Txn
+	idx []int // The keys, written by tx.
+}
+
+func (b *batchWriter) init(n int) {
+	b.errs = make([]error,n)
+	b.txns = make(map[*badger.DB]*batchTxn)
+}
+func (b *batchWriter) fail(i int, err error) {
+	b.lck.Lock(); defer b.lck.Unlock()
+	if b.errs[i]==nil { b.errs[i] = err }
+}
+func (b *batchWriter) set(db *badger.DB, i int, ent *badger.Entry) {
+	t := b.txns[db]
+	if t==nil {
+		t = &batchTxn{tx:db.NewTransaction(true)}
+		b.txns[db] = t
+	}
+	err := t.tx.SetEntry(ent)
+	if err==badger.ErrTxnTooBig {
+		// Commit, what we have so far and continue with a fresh transaction.
+		b.commit(t)
+		t.tx,t.idx = db.NewTransaction(true),nil
+		err = t.tx.SetEntry(ent)
+	}
+	if err!=nil { b.fail(i,err); return }
+	t.idx = append(t.idx,i)
+}
+func (b *batchWriter) commit(t *batchTxn) {
+	idx := t.idx
+	b.wg.Add(1)
+	t.tx.CommitWith(func(err error) {
+		if err!=nil { for _,i := range idx { b.fail(i,err) } }
+		b.wg.Done()
+	})
+}
+func (b *batchWriter) wait() {
+	for _,t := range b.txns { b.commit(t) }
+	b.wg.Wait()
+}
+
+type putKey struct{
+	hashnum int
+	ent     badger.Entry
+}
+
+func (s *Store) i_MultiPut(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) {
+	defer d.Release(msg)
+	n,err := decodeCount(d)
+	if err!=nil { w.Log.Debug("malformed MH_MultiPut","err",err); return }
+	
+	keys := make([]putKey,n)
+	for i := range keys {
+		k := &keys[i]
+		k.hashnum,err = d.DecodeInt()
+		if err!=nil { w.Log.Debug("malformed MH_MultiPut","err",err); return }
+		k.ent.UserMeta,err = d.DecodeUint8()
+		if err!=nil { w.Log.Debug("malformed MH_MultiPut","err",err); return }
+		k.ent.ExpiresAt,err = d.DecodeUint64()
+		if err!=nil { w.Log.Debug("malformed MH_MultiPut","err",err); return }
+		k.ent.Key,err = d.DecodeBytes()
+		if err!=nil { w.Log.Debug("malformed MH_MultiPut","err",err); return }
+		k.ent.Value,err = d.DecodeBytes()
+		if err!=nil { w.Log.Debug("malformed MH_MultiPut","err",err); return }
+	}
+	
+	target,err := d.DecodeString()
+	if err!=nil { w.Log.Debug("malformed MH_MultiPut","err",err); return }
+	
+	targid,err := d.DecodeUint64()
+	if err!=nil { w.Log.Debug("malformed MH_MultiPut","err",err); return }
+	
+	sp := w.Tracer.Start(d,"db multi-put")
+	if sp!=nil { sp.SetAttr("count",n) }
+	defer sp.Finish()
+	
+	// Like i_Put, hold the locks of all keys, until the batch is written.
+	ks := make([][]byte,n)
+	for i := range keys { ks[i] = keys[i].ent.Key }
+	unlock := s.klck.lockAll(ks)
+	
+	resp := make([]int,n)
+	pls := make([]placement,0,n)
+	var b batchWriter
+	b.init(n)
+	for i := range keys {
+		k := &keys[i]
+		rawdata := true
+		switch k.ent.UserMeta {
+		case META_Raw: break
+		case META_OuterRedirect:
+			if s.tombstoned(k.hashnum,k.ent.Key) { resp[i] = RESP_Deleted; continue }
+			rawdata = false
+		default:
+			resp[i] = RESP_Illegal
+			continue
+		}
+		pl,ok := s.place(k.hashnum,rawdata,&k.ent)
+		if !ok {
+			w.Metrics.Counter("cherdy_db_no_space_total","Puts, rejected because no shard had free space.").Inc()
+			b.fail(i,ErrNoSpace)
+			continue
+		}
+		b.set(pl.store,i,pl.ent)
+		if pl.hint!=nil { b.set(pl.hstore,i,pl.hint) }
+		pls = append(pls,pl)
+	}
+	b.wait()
+	unlock()
+	
+	for _,pl := range pls { s.touch(pl) }
+	
+	node := w.Lookup(target)
+	if node==nil {
+		w.Log.Debug("multi-put response dropped","reason","unknown-requester","target",target)
+		return
+	}
+	
+	mb := w.NewMessage()
+	mb.EncodeMulti(MH_MultiPutResponse,targid,RESP_OK,n)
+	for i,e := range b.errs {
+		if e!=nil {
+			if e!=ErrNoSpace {
+				w.Log.Error("put failed","key",keys[i].ent.Key,"err",e)
+				ioError(w,"multi-put")
+			}
+			mb.EncodeMulti(RESP_IoError,unwrapCause(e).Error())
+		} else {
+			mb.EncodeMulti(resp[i],nil)
+		}
+	}
+	w.SendTo(mlst.ST_BestFit,node,mb.Bytes())
+}
+func (s *Store) MultiPut(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) bool {
+	mlst.RetainBinary(d)
+	go s.i_MultiPut(w,d,msg)
+	return false
+}
+
@@ -0,0 +1,73 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package db
+
+import (
+	"github.com/dgraph-io/badger"
+	"github.com/vmihailenco/msgpack"
+	"testing"
+)
+
+func TestMultiPutGet(t *testing.T) {
+	c,_ := stores(t,2,0)
+	w := c.Nodes[1]
+	expect(t,call(t,w,"node-0",MH_MultiPut,3,
+		0,META_Raw,0,[]byte("a"),[]byte("A"),
+		1,META_Raw,0,[]byte("b"),[]byte("B"),
+		2,META_Raw,0,[]byte("c"),[]byte("C"),
+	),"[0 3 0 <nil> 0 <nil> 0 <nil>]")
+	expect(t,call(t,w,"node-0",MH_MultiGet,4,
+		0,[]byte("a"),
+		1,[]byte("b"),
+		2,[]byte("c"),
+		0,[]byte("missing"),
+	),"[0 4 0 A 0 B 0 C 1 <nil>]")
+	
+	// Single-key requests see the batch and vice versa.
+	expect(t,call(t,w,"node-0",MH_Get,1,[]byte("b")),"[0 B]")
+	expect(t,call(t,w,"node-0",MH_Delete,2,[]byte("c")),"[0]")
+	expect(t,call(t,w,"node-0",MH_MultiGet,1,2,[]byte("c")),"[0 1 1 <nil>]")
+}
+
+/*
+A redirect chain, that leads back to its start, is reported as an I/O error by every
+operation, instead of being followed forever.
+*/
+func TestRedirectCycle(t *testing.T) {
+	c,ss := stores(t,2,0)
+	w := c.Nodes[1]
+	s := ss[0]
+	key := []byte("cycle")
+	for i,db := range s.Data {
+		next,_ := msgpack.Marshal(1-i)
+		tx := db.NewTransaction(true)
+		tx.SetEntry(&badger.Entry{Key:key,Value:next,UserMeta:META_InnerRedirect})
+		if err := tx.Commit(); err!=nil { t.Fatal(err) }
+	}
+	
+	expect(t,call(t,w,"node-0",MH_Get,0,key),"[2 Redirect Loop]")
+	expect(t,call(t,w,"node-0",MH_GetVersioned,1,key),"[2 Redirect Loop]")
+	expect(t,call(t,w,"node-0",MH_MultiGet,1,0,key),"[0 1 2 Redirect Loop]")
+	expect(t,call(t,w,"node-0",MH_Delete,0,key),"[2 Redirect Loop]")
+}
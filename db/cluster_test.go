@@ -0,0 +1,130 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package db
+
+import (
+	"fmt"
+	"github.com/byte-mug/cherdy/mlst"
+	"github.com/byte-mug/cherdy/simnet"
+	"github.com/dgraph-io/badger"
+	"github.com/hashicorp/memberlist"
+	"hash/fnv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func open(t *testing.T) *badger.DB {
+	o := badger.DefaultOptions(t.TempDir())
+	o.Logger = nil
+	// Keep the memory footprint small, the tests open many databases.
+	o.MaxTableSize = 1<<20
+	o.ValueLogFileSize = 1<<20
+	o.NumMemtables = 1
+	o.NumCompactors = 1
+	db,err := badger.Open(o)
+	if err!=nil { t.Fatal(err) }
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+/*
+A ring, where every node owns every key.
+*/
+type staticRing []string
+func (r staticRing) KeyOwners(key []byte) []string { return r }
+func (r staticRing) KeyRange(key []byte) (string,[]string) { return "all",r }
+func (r staticRing) KeyHashnum(key []byte) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32()&0x7fffffff)
+}
+
+/*
+Starts n nodes with a Store of two shards each. If owners is not 0, the first
+owners nodes replicate all keys.
+*/
+func stores(t *testing.T, n, owners int) (*simnet.Cluster,[]*Store) {
+	var ring staticRing
+	for i := 0; i<owners; i++ { ring = append(ring,fmt.Sprintf("node-%d",i)) }
+	ss := make([]*Store,n)
+	c,err := simnet.NewCluster(simnet.NewNetwork(1),n,func(i int, wn *mlst.WrapNode, cfg *memberlist.Config) {
+		s := &Store{Redirects:open(t),Data:[]*badger.DB{open(t),open(t)},Hints:open(t)}
+		if owners!=0 { s.Repl.Ring = ring }
+		s.Attach(wn)
+		ss[i] = s
+	})
+	if err!=nil { t.Fatal(err) }
+	t.Cleanup(c.Shutdown)
+	if err = c.WaitMembers(n,time.Second*5); err!=nil { t.Fatal(err) }
+	return c,ss
+}
+
+/*
+Sends a request from w to the named node and returns the values of the reply after
+the call-id, formatted by fmt.Sprint. Byte strings are rendered as strings. The
+request is completed by target and targid.
+*/
+func call(t *testing.T, w *mlst.WrapNode, to string, vs ...interface{}) string {
+	nd := w.Lookup(to)
+	if nd==nil { t.Fatalf("%s does not know %s",w.Name,to) }
+	rs,_ := w.RequestMany(mlst.ST_BestFit,[]*memberlist.Node{nd},1,time.Second*3,func(id uint64) []byte {
+		mb := w.NewMessage()
+		mb.EncodeMulti(vs...)
+		mb.EncodeMulti(w.Name,id)
+		return mb.Bytes()
+	})
+	if len(rs)==0 { t.Fatalf("no reply to %v",vs[0]) }
+	defer rs[0].Free()
+	return fmt.Sprint(values(t,rs[0].MessageReader))
+}
+
+func values(t *testing.T, d *mlst.MessageReader) (vs []interface{}) {
+	for d.Len()>0 {
+		v,err := d.DecodeInterface()
+		if err!=nil { t.Fatal(err) }
+		vs = append(vs,printable(v))
+	}
+	return
+}
+func printable(v interface{}) interface{} {
+	switch x := v.(type) {
+	case []byte: return string(x)
+	case []interface{}:
+		for i := range x { x[i] = printable(x[i]) }
+	}
+	return v
+}
+
+func expect(t *testing.T, got, want string) {
+	t.Helper()
+	if got!=want { t.Fatalf("got %s, want %s",got,want) }
+}
+
+/*
+Splits a reply, as returned by call, into its values.
+*/
+func fields(reply string) []string {
+	return strings.Fields(strings.Trim(reply,"[]"))
+}
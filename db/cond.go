@@ -0,0 +1,295 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package db
+
+import (
+	"github.com/dgraph-io/badger"
+	"github.com/byte-mug/cherdy/mlst"
+	"github.com/byte-mug/golibs/bufferex"
+	
+	"bytes"
+	"crypto/sha256"
+	"hash/fnv"
+	"github.com/vmihailenco/msgpack"
+	"sync"
+	"time"
+)
+
+/*
+Preconditions of MH_CondPut:
+
+	MH_CondPut, hashnum, cond, arg, expiresAt, key, value, target, targid
+
+The argument depends on the condition. The response is
+
+	MH_PutResponse, targid, resp, version
+
+where version is the new version on RESP_OK and the current version (0, if the key
+is absent or has no version) on RESP_Conflict.
+*/
+const (
+	COND_IfAbsent  = 1+iota // arg: nil
+	COND_IfVersion          // arg: the expected version. 0 means absent or unversioned.
+	COND_IfHash             // arg: ValueHash of the expected value.
+)
+
+/*
+Returns the hash, COND_IfHash compares against.
+*/
+func ValueHash(value []byte) []byte {
+	h := sha256.Sum256(value)
+	return h[:]
+}
+
+/*
+The value of a META_Versioned entry is prefixed with it's msgpack-encoded version.
+*/
+func versioned(version uint64, value []byte) []byte {
+	b,_ := msgpack.Marshal(version)
+	return append(b,value...)
+}
+func unversion(b []byte) (version uint64, value []byte, err error) {
+	r := bytes.NewReader(b)
+	err = msgpack.NewDecoder(r).Decode(&version)
+	value = b[len(b)-r.Len():]
+	return
+}
+
+/*
+Returns a copy of the value and the version of the item. Entries without a stored
+version (legacy and raw puts) report version 0. Badger's own item version is local
+to each database and not comparable between shards or replicas.
+*/
+func itemValue(item *badger.Item) (value []byte, version uint64, err error) {
+	value,err = item.ValueCopy(nil)
+	if err!=nil { return }
+	switch item.UserMeta() {
+	case META_Versioned:
+		version,value,err = unversion(value)
+		return
+	case META_Tombstone:
+		version,err = tombVersion(value)
+		return nil,version,err
+	}
+	return value,0,nil
+}
+
+/*
+The value of a tombstone is versioned(version,nil). Tombstones without a value carry
+no version and report 0.
+*/
+func tombVersion(b []byte) (version uint64, err error) {
+	if len(b)==0 { return 0,nil }
+	version,_,err = unversion(b)
+	return
+}
+
+/*
+Returns the version for a new write, that supersedes cur.
+*/
+func nextVersion(cur uint64) uint64 {
+	v := uint64(time.Now().UnixNano())
+	if v<=cur { v = cur+1 }
+	return v
+}
+
+/*
+Striped locks, that serialize all writes on the same key. Every writer takes the lock
+of the key, so a read-modify-write operation can't be interleaved with another write.
+*/
+const keyStripes = 64
+
+type keyLocks [keyStripes]sync.Mutex
+
+func (k *keyLocks) stripe(key []byte) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32()%keyStripes)
+}
+func (k *keyLocks) lock(key []byte) *sync.Mutex {
+	m := &k[k.stripe(key)]
+	m.Lock()
+	return m
+}
+
+/*
+Locks the stripes of all keys in ascending order, so that concurrent batches can't
+deadlock. Returns the function, that unlocks them.
+*/
+func (k *keyLocks) lockAll(keys [][]byte) (unlock func()) {
+	var taken [keyStripes]bool
+	for _,key := range keys { taken[k.stripe(key)] = true }
+	for i,t := range taken { if t { k[i].Lock() } }
+	return func() {
+		for i,t := range taken { if t { k[i].Unlock() } }
+	}
+}
+
+/*
+The current state of a key, as seen by a read-modify-write operation.
+*/
+type current struct{
+	db      *badger.DB // The database, that holds the value, or nil.
+	value   []byte
+	version uint64 // The version of the value or of the tombstone.
+	deleted bool   // The key has a tombstone.
+	redir   string // The node, the key has been redirected to.
+}
+
+func (s *Store) current(hashnum int, key []byte) (cur current,err error) {
+	c := make(txnCache)
+	defer c.discard()
+	db,item,err := s.lookup(c,hashnum,key)
+	if err==badger.ErrKeyNotFound { return cur,nil }
+	if err!=nil { return }
+	switch item.UserMeta() {
+	case META_Tombstone:
+		cur.deleted = true
+		_,cur.version,err = itemValue(item)
+		return
+	case META_OuterRedirect:
+		var b []byte
+		b,err = item.ValueCopy(nil)
+		cur.redir = string(b)
+		return
+	}
+	cur.db = db
+	cur.value,cur.version,err = itemValue(item)
+	return
+}
+
+/*
+Writes ent into the database, that holds the current value, or into a newly chosen
+shard.
+*/
+func (s *Store) replace(hashnum int, cur current, ent *badger.Entry) error {
+	if cur.db!=nil { return cur.db.Update(func(tx *badger.Txn) error { return tx.SetEntry(ent) }) }
+	pl,ok := s.place(hashnum,true,ent)
+	if !ok { return ErrNoSpace }
+	defer s.touch(pl)
+	if err := s.write(pl); err!=nil { return err }
+	if cur.deleted { return s.untomb(hashnum,ent.Key,pl) }
+	return nil
+}
+
+/*
+Deletes the tombstone in the home shard, unless the placement has overwritten it
+already. Otherwise the tombstone would hide the value, that has been written into
+another shard or the Redirects DB.
+*/
+func (s *Store) untomb(hashnum int, key []byte, pl placement) error {
+	home := s.home(hashnum)
+	if home==nil || home==pl.store || (pl.hint!=nil && home==pl.hstore) { return nil }
+	return home.Update(func(tx *badger.Txn) error { return tx.Delete(key) })
+}
+
+func (s *Store) i_CondPut(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) {
+	defer d.Release(msg)
+	hashnum,err := d.DecodeInt()
+	if err!=nil { w.Log.Debug("malformed MH_CondPut","err",err); return }
+	
+	cond,err := d.DecodeInt()
+	if err!=nil { w.Log.Debug("malformed MH_CondPut","err",err); return }
+	
+	var version uint64
+	var hash []byte
+	switch cond {
+	case COND_IfAbsent: err = d.DecodeNil()
+	case COND_IfVersion: version,err = d.DecodeUint64()
+	case COND_IfHash: hash,err = d.DecodeBytes()
+	default: err = d.Skip()
+	}
+	if err!=nil { w.Log.Debug("malformed MH_CondPut","err",err); return }
+	
+	expiresAt,err := d.DecodeUint64()
+	if err!=nil { w.Log.Debug("malformed MH_CondPut","err",err); return }
+	
+	key,err := d.DecodeBytes()
+	if err!=nil { w.Log.Debug("malformed MH_CondPut","err",err); return }
+	
+	value,err := d.DecodeBytes()
+	if err!=nil { w.Log.Debug("malformed MH_CondPut","err",err); return }
+	
+	target,err := d.DecodeString()
+	if err!=nil { w.Log.Debug("malformed MH_CondPut","err",err); return }
+	
+	targid,err := d.DecodeUint64()
+	if err!=nil { w.Log.Debug("malformed MH_CondPut","err",err); return }
+	
+	sp := w.Tracer.Start(d,"db cond-put")
+	defer sp.Finish()
+	
+	m := s.klck.lock(key)
+	defer m.Unlock()
+	
+	cur,err := s.current(hashnum,key)
+	if err!=nil {
+		w.Log.Error("cond-put failed","key",key,"err",err)
+		ioError(w,"cond-put")
+		s.i_Respond(w,MH_PutResponse,target,targid,RESP_IoError,unwrapCause(err).Error())
+		return
+	}
+	if cur.redir!="" {
+		s.i_Respond(w,MH_PutResponse,target,targid,RESP_Redirect,cur.redir)
+		return
+	}
+	
+	var ok bool
+	exists := cur.db!=nil
+	
+	// A deleted key is absent. The version of it's tombstone is only used to order the next write.
+	have := cur.version
+	if !exists { have = 0 }
+	switch cond {
+	case COND_IfAbsent: ok = !exists
+	case COND_IfVersion: ok = version==have
+	case COND_IfHash: ok = exists && bytes.Equal(hash,ValueHash(cur.value))
+	default:
+		w.Log.Debug("cond-put rejected","reason","illegal-cond","cond",cond,"key",key)
+		s.i_Respond(w,MH_PutResponse,target,targid,RESP_Illegal)
+		return
+	}
+	if !ok {
+		w.Log.Debug("cond-put rejected","reason","conflict","key",key,"version",have)
+		w.Metrics.Counter("cherdy_db_conflicts_total","Conditional writes, rejected because of a failed precondition.").Inc()
+		s.i_Respond(w,MH_PutResponse,target,targid,RESP_Conflict,have)
+		return
+	}
+	
+	nv := nextVersion(cur.version)
+	ent := &badger.Entry{Key:key,Value:versioned(nv,value),UserMeta:META_Versioned,ExpiresAt:expiresAt}
+	if err = s.replace(hashnum,cur,ent); err!=nil {
+		w.Log.Error("cond-put failed","key",key,"err",err)
+		if err!=ErrNoSpace { ioError(w,"cond-put") }
+		s.i_Respond(w,MH_PutResponse,target,targid,RESP_IoError,unwrapCause(err).Error())
+		return
+	}
+	s.i_Respond(w,MH_PutResponse,target,targid,RESP_OK,nv)
+}
+func (s *Store) CondPut(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) bool {
+	mlst.RetainBinary(d)
+	go s.i_CondPut(w,d,msg)
+	return false
+}
+
@@ -0,0 +1,95 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package db
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestCondPut(t *testing.T) {
+	c,_ := stores(t,2,0)
+	w := c.Nodes[1]
+	k := []byte("key")
+	put := func(cond int, arg interface{}, value string) []string {
+		return fields(call(t,w,"node-0",MH_CondPut,1,cond,arg,0,k,[]byte(value)))
+	}
+	
+	r := put(COND_IfAbsent,nil,"v1")
+	if r[0]!="0" { t.Fatalf("IfAbsent on a missing key: %v",r) }
+	v1,_ := strconv.ParseUint(r[1],10,64)
+	if r = put(COND_IfAbsent,nil,"v2"); r[0]!="7" || r[1]!=strconv.FormatUint(v1,10) { t.Fatalf("IfAbsent on an existing key: %v",r) }
+	
+	if r = put(COND_IfHash,ValueHash([]byte("other")),"v2"); r[0]!="7" { t.Fatalf("IfHash with a wrong hash: %v",r) }
+	if r = put(COND_IfHash,ValueHash([]byte("v1")),"v2"); r[0]!="0" { t.Fatalf("IfHash: %v",r) }
+	v2,_ := strconv.ParseUint(r[1],10,64)
+	if v2<=v1 { t.Fatalf("version %d after %d",v2,v1) }
+	
+	if r = put(COND_IfVersion,v2-1,"v3"); r[0]!="7" { t.Fatalf("IfVersion with a stale version: %v",r) }
+	if r = put(COND_IfVersion,v2,"v3"); r[0]!="0" { t.Fatalf("IfVersion: %v",r) }
+	expect(t,call(t,w,"node-0",MH_Get,1,k),"[0 v3]")
+	if r = put(99,nil,"v4"); r[0]!="4" { t.Fatalf("illegal condition: %v",r) }
+	
+	// A deleted key is absent again.
+	expect(t,call(t,w,"node-0",MH_Delete,1,k),"[0]")
+	if r = put(COND_IfVersion,0,"v5"); r[0]!="0" { t.Fatalf("IfVersion 0 on a deleted key: %v",r) }
+}
+
+/*
+Concurrent read-modify-write cycles: only one writer of each version succeeds.
+*/
+func TestCondPutRace(t *testing.T) {
+	c,_ := stores(t,2,0)
+	w := c.Nodes[1]
+	k := []byte("counter")
+	
+	var wg sync.WaitGroup
+	var lck sync.Mutex
+	wins := 0
+	for i := 0; i<8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j<5; j++ {
+				r := fields(call(t,w,"node-0",MH_GetVersioned,1,k))
+				var version uint64
+				n := 0
+				if r[0]=="0" {
+					version,_ = strconv.ParseUint(r[2],10,64)
+					n,_ = strconv.Atoi(r[1])
+				}
+				r = fields(call(t,w,"node-0",MH_CondPut,1,COND_IfVersion,version,0,k,[]byte(strconv.Itoa(n+1))))
+				if r[0]=="0" {
+					lck.Lock()
+					wins++
+					lck.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if wins==0 { t.Fatal("no write succeeded") }
+	expect(t,call(t,w,"node-0",MH_Get,1,k),"[0 "+strconv.Itoa(wins)+"]")
+}
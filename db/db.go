@@ -33,6 +33,7 @@ import (
 	perrors "github.com/pkg/errors"
 	"github.com/vmihailenco/msgpack"
 	"sync"
+	"time"
 )
 
 const (
@@ -40,6 +41,24 @@ const (
 	MH_GetResponse
 	MH_Put
 	MH_PutResponse
+	MH_Delete
+	MH_DeleteResponse
+	MH_MultiGet
+	MH_MultiGetResponse
+	MH_MultiPut
+	MH_MultiPutResponse
+	MH_Scan
+	MH_ScanResponse
+	MH_CondPut
+	MH_Update
+	MH_UpdateResponse
+	MH_ReplPut
+	MH_ReplGet
+	MH_AESync
+	MH_AESyncResponse
+	MH_AEPull
+	MH_GetVersioned
+	MH_ReplDelete
 )
 
 const (
@@ -49,27 +68,79 @@ const (
 	RESP_DeadTargetNode
 	
 	RESP_Illegal
+	RESP_Deleted
+	RESP_Redirect // The key lives on another node, that is not asked by the receiver.
+	RESP_Conflict
+	RESP_TypeMismatch
+	RESP_Overflow
+	RESP_QuorumFailed
 )
 
 const (
 	META_Raw = iota
 	META_InnerRedirect
 	META_OuterRedirect
+	META_Tombstone
+	META_Versioned
+	META_Hint // Only in Store.Hints.
 )
 
+/*
+Single-key requests and their responses:
+
+	MH_Get, hashnum, key, target, targid
+	MH_GetVersioned, hashnum, key, target, targid
+	MH_Put, hashnum, meta, expiresAt, key, value, target, targid
+	MH_Delete, hashnum, key, target, targid
+	
+	MH_GetResponse, targid, resp[, value]
+	MH_GetResponse, targid, resp (answers MH_Put)
+	MH_DeleteResponse, targid, resp
+
+The value follows RESP_OK on get. MH_GetVersioned is answered like MH_Get, but
+RESP_OK carries the value, it's version (0 for unversioned entries) and expiresAt,
+and a deleted key is reported as RESP_Deleted, followed by the version and expiresAt
+of it's tombstone.
+On RESP_IoError, the error string follows resp.
+The batch requests (see batch.go) report the same codes for every key.
+*/
+func init() {
+	mlst.RegisterSchema(MH_Get,mlst.Schema{Name:"MH_Get",Fields:[]string{"hashnum","key","target","targid"}})
+	mlst.RegisterSchema(MH_GetResponse,mlst.Schema{Name:"MH_GetResponse",Fields:[]string{"targid","resp"}})
+	mlst.RegisterSchema(MH_Put,mlst.Schema{Name:"MH_Put",Fields:[]string{"hashnum","meta","expiresAt","key","value","target","targid"}})
+	mlst.RegisterSchema(MH_PutResponse,mlst.Schema{Name:"MH_PutResponse",Fields:[]string{"targid","resp"}})
+	mlst.RegisterSchema(MH_Delete,mlst.Schema{Name:"MH_Delete",Fields:[]string{"hashnum","key","target","targid"}})
+	mlst.RegisterSchema(MH_DeleteResponse,mlst.Schema{Name:"MH_DeleteResponse",Fields:[]string{"targid","resp"}})
+	mlst.RegisterSchema(MH_MultiGet,mlst.Schema{Name:"MH_MultiGet",Fields:[]string{"count"}})
+	mlst.RegisterSchema(MH_MultiGetResponse,mlst.Schema{Name:"MH_MultiGetResponse",Fields:[]string{"targid","resp","count"}})
+	mlst.RegisterSchema(MH_MultiPut,mlst.Schema{Name:"MH_MultiPut",Fields:[]string{"count"}})
+	mlst.RegisterSchema(MH_MultiPutResponse,mlst.Schema{Name:"MH_MultiPutResponse",Fields:[]string{"targid","resp","count"}})
+	mlst.RegisterSchema(MH_Scan,mlst.Schema{Name:"MH_Scan",Fields:[]string{"prefix","start","end","limit","token","target","targid"}})
+	mlst.RegisterSchema(MH_CondPut,mlst.Schema{Name:"MH_CondPut",Fields:[]string{"hashnum","cond","arg","expiresAt","key","value","target","targid"}})
+	mlst.RegisterSchema(MH_Update,mlst.Schema{Name:"MH_Update",Fields:[]string{"hashnum","op","arg","expiresAt","key","target","targid"}})
+	mlst.RegisterSchema(MH_UpdateResponse,mlst.Schema{Name:"MH_UpdateResponse",Fields:[]string{"targid","resp"}})
+	mlst.RegisterSchema(MH_ReplPut,mlst.Schema{Name:"MH_ReplPut",Fields:[]string{"expiresAt","key","value","quorum","target","targid"}})
+	mlst.RegisterSchema(MH_ReplGet,mlst.Schema{Name:"MH_ReplGet",Fields:[]string{"key","consistency","target","targid"}})
+	mlst.RegisterSchema(MH_AESync,mlst.Schema{Name:"MH_AESync",Fields:[]string{"range","root","leaves","target","targid"}})
+	mlst.RegisterSchema(MH_AESyncResponse,mlst.Schema{Name:"MH_AESyncResponse",Fields:[]string{"targid","resp","buckets","count"}})
+	mlst.RegisterSchema(MH_AEPull,mlst.Schema{Name:"MH_AEPull",Fields:[]string{"count"}})
+	mlst.RegisterSchema(MH_ReplDelete,mlst.Schema{Name:"MH_ReplDelete",Fields:[]string{"key","quorum","target","targid"}})
+	mlst.RegisterSchema(MH_GetVersioned,mlst.Schema{Name:"MH_GetVersioned",Fields:[]string{"hashnum","key","target","targid"}})
+	mlst.RegisterSchema(MH_ScanResponse,mlst.Schema{Name:"MH_ScanResponse",Fields:[]string{"targid","resp","count"}})
+}
+
 var (
 	ErrLoop = gerrors.New("Redirect Loop")
+	ErrNoSpace = gerrors.New("No Disk Space")
+	ErrBadCount = gerrors.New("Bad Element Count")
+	ErrIllegal = gerrors.New("Illegal Operation")
 	
 	errNil = gerrors.New("<nil>")
 )
 
 func unwrapCause(err error) error {
-	if err!=nil { return errNil }
-	for {
-		nerr := perrors.Cause(err)
-		if nerr==nil || nerr==err { return err }
-	}
-	panic("unreachable")
+	if err==nil { return errNil }
+	return perrors.Cause(err)
 }
 
 type myItem struct {
@@ -84,6 +155,7 @@ func modulo(i,m int) int {
 }
 
 func db_get(db *badger.DB,key []byte) (myItem,error) {
+	if db==nil { return myItem{},badger.ErrKeyNotFound }
 	tx := db.NewTransaction(false)
 	it,err := tx.Get(key)
 	if err!=nil {
@@ -106,6 +178,10 @@ func db_put(db *badger.DB,ent *badger.Entry,f func(error)) {
 	tx.SetEntry(ent)
 }
 
+func ioError(w *mlst.WrapNode, op string) {
+	w.Metrics.Counter("cherdy_db_io_errors_total","Badger I/O errors by operation.","op",op).Inc()
+}
+
 type Freespace interface{
 	Touch()
 	HasFreeSpace(key,value int) bool
@@ -120,47 +196,173 @@ type Store struct {
 	Data      []*badger.DB
 	
 	Freespace []Freespace
-}
-
-func (s *Store) i_Get(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) {
-	defer msg.Free()
-	var item myItem
-	var ierr error
-	hashnum,err := d.DecodeInt()
-	if err!=nil { return }
 	
-	key,err := d.DecodeBytes()
-	if err!=nil { return }
+	// How long tombstones of deleted keys are kept. Default: DefaultTombstoneTTL
+	TombstoneTTL time.Duration
 	
+	// A dedicated database for the hints of unreachable replicas. If nil, hinted
+	// handoff is disabled.
+	Hints *badger.DB
+	
+	// Replicated operations. See MH_ReplPut, MH_ReplDelete and MH_ReplGet.
+	Repl Replication
+	
+	klck keyLocks
+	ae   antiEntropy
+	hlck sync.Mutex // Serializes hint replays.
+}
+
+/*
+Returns Data[i] or nil, if there is no such shard.
+*/
+func (s *Store) shard(i int) *badger.DB {
+	if i<0 || i>=len(s.Data) { return nil }
+	return s.Data[i]
+}
+
+/*
+Returns the home shard of hashnum or the Redirects DB, if there is none.
+*/
+func (s *Store) home(hashnum int) *badger.DB {
+	db := s.shard(modulo(hashnum,len(s.Data)))
+	if db==nil { db = s.Redirects }
+	return db
+}
+
+/*
+Follows the META_InnerRedirect chain of a key, starting at the home shard of hashnum.
+visit is called with the shard of every hop and returns the value of the redirect
+entry, it found, and true, or false, if the chain ends here. Cycles of any length
+are reported as ErrLoop.
+*/
+func (s *Store) follow(hashnum int, visit func(shard *badger.DB) ([]byte,bool,error)) error {
 	usehash := hashnum
+	seen := make(map[int]bool)
 	for {
-		var choice [2]*badger.DB
+		if seen[usehash] { return ErrLoop }
+		seen[usehash] = true
 		
-		if l := len(s.Data); l>0 { choice[0] = s.Data[usehash%l] }
-		choice[1] = s.Redirects
-		
-		ierr = badger.ErrKeyNotFound
-		for _,db := range choice {
-			item,ierr = db_get(db,key)
-			if ierr==nil { break }
+		next,ok,err := visit(s.shard(modulo(usehash,len(s.Data))))
+		if err!=nil || !ok { return err }
+		if err = msgpack.Unmarshal(next,&usehash); err!=nil { return err }
+	}
+}
+
+/*
+The outcome of placing a put into the shards.
+*/
+type placement struct{
+	pos_1,pos_2 int // The home shard and the choosen shard.
+	
+	store *badger.DB
+	ent   *badger.Entry
+	
+	// The META_InnerRedirect hint, if the data is not stored in it's home shard.
+	hstore *badger.DB
+	hint   *badger.Entry
+}
+
+/*
+Chooses the shard, ent is written into. Returns false, if no shard has free space.
+*/
+func (s *Store) place(hashnum int, rawdata bool, ent *badger.Entry) (pl placement,ok bool) {
+	l := len(s.Data)
+	f := len(s.Freespace)
+	klen,vlen := len(ent.Key),len(ent.Value)
+	pl.pos_1 = modulo(hashnum,l)
+	pl.pos_2 = pl.pos_1
+	pl.ent = ent
+	
+	hfs := !rawdata
+	if !hfs {
+		var fs Freespace
+		if pl.pos_2>=0 && pl.pos_2<f { fs = s.Freespace[pl.pos_2] }
+		hfs = s.shard(pl.pos_2)!=nil
+		if fs!=nil && hfs { hfs = fs.HasFreeSpace(klen,vlen) }
+	}
+	if !hfs {
+		for i := 0 ; i<l; i++ {
+			var fs Freespace
+			if i<f { fs = s.Freespace[i] }
+			hfs = s.Data[i]!=nil
+			if fs!=nil && hfs { hfs = fs.HasFreeSpace(klen,vlen) }
+			if hfs {
+				pl.pos_2 = i
+				break
+			}
 		}
-		
-		if ierr!=nil { break }
-		switch item.UserMeta() {
-		case META_InnerRedirect:
-			cnum := usehash
-			ierr = item.Value(func(b []byte) error { return msgpack.Unmarshal(b,&usehash) })
-			item.Discard() // Drop item/transaction
-			item = myItem{}
-			
-			// if cnum == usehash, we use the same usehash --> loop
-			if ierr==nil && cnum==usehash { ierr = ErrLoop }
-			
-			if ierr==nil { continue } // perform next.
+	}
+	if !hfs { return }
+	
+	pl.store = s.home(pl.pos_2)
+	if pl.pos_2>=0 && pl.pos_2<f && pl.store!=s.Redirects && !rawdata {
+		f := s.Freespace[pl.pos_2]
+		if f!=nil {
+			if !f.HasFreeSpace(klen,vlen) { pl.store = s.Redirects }
 		}
-		if item.tx!=nil { defer item.Discard() }
-		break
 	}
+	if pl.store==nil { return }
+	
+	/*
+	If we have put our data into a bucket != the specified target, we need to put a hint into
+	the destination or redirect bucket, that points to the choosen destination.
+	*/
+	if pl.pos_1!=pl.pos_2 && pl.store!=s.Redirects {
+		data,_ := msgpack.Marshal(pl.pos_2)
+		pl.hstore = s.home(pl.pos_1)
+		if pl.hstore!=nil { pl.hint = &badger.Entry{Key:ent.Key,Value:data,UserMeta:META_InnerRedirect,ExpiresAt:ent.ExpiresAt} }
+	}
+	return pl,true
+}
+/*
+Writes the entry and the hint of a placement.
+*/
+func (s *Store) write(pl placement) (reterr error) {
+	var wg sync.WaitGroup
+	CB := errsetter(&wg,&reterr)
+	
+	wg.Add(1)
+	db_put(pl.store,pl.ent,CB)
+	if pl.hint!=nil {
+		wg.Add(1)
+		db_put(pl.hstore,pl.hint,CB)
+	}
+	
+	wg.Wait()
+	return
+}
+func (s *Store) touch(pl placement) {
+	f := len(s.Freespace)
+	if pl.pos_1>=0 && pl.pos_1<f { freespacetouch(s.Freespace[pl.pos_1]) }
+	if pl.pos_1!=pl.pos_2 && pl.pos_2<f { freespacetouch(s.Freespace[pl.pos_2]) }
+}
+
+/*
+Serves MH_Get and MH_GetVersioned. If withVersion is true, RESP_OK carries the version
+and expiresAt of the entry.
+*/
+func (s *Store) i_Get(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary, withVersion bool) {
+	defer d.Release(msg)
+	header := uint64(MH_Get)
+	if withVersion { header = MH_GetVersioned }
+	hashnum,err := d.DecodeInt()
+	if err!=nil { w.Log.Debug("malformed MH_Get","err",err); return }
+	
+	key,err := d.DecodeBytes()
+	if err!=nil { w.Log.Debug("malformed MH_Get","err",err); return }
+	
+	// If the sender has already given up, don't waste I/O.
+	if d.Context().Err()!=nil {
+		w.Log.Debug("get discarded","reason","deadline","key",key)
+		return
+	}
+	
+	sp := w.Tracer.Start(d,"db get")
+	defer sp.Finish()
+	
+	c := make(txnCache)
+	defer c.discard()
+	_,item,ierr := s.lookup(c,hashnum,key)
 	
 	var target string
 	resp := RESP_OK
@@ -175,37 +377,69 @@ func (s *Store) i_Get(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Bina
 			
 			node := w.Lookup(target)
 			
-			if node==nil { resp = RESP_DeadTargetNode; break }
+			if node==nil {
+				w.Log.Warn("redirect target is dead","key",key,"target",target)
+				resp = RESP_DeadTargetNode
+				break
+			}
+			
+			// If the sender has already given up, don't forward.
+			if d.Context().Err()!=nil {
+				w.Log.Debug("redirect discarded","reason","deadline","key",key,"target",target)
+				return
+			}
+			
+			fsp := w.Tracer.Start(d,"redirect forward")
+			if fsp!=nil { fsp.SetAttr("to",target) }
 			
-			mb := new(mlst.MessageBuffer).Init()
+			mb := w.NewMessage()
 			
 			// Rewrite the header.
-			mb.EncodeMulti(MH_Get,hashnum,key)
+			mb.EncodeEnvelope(d)
+			mb.EncodeMulti(header,hashnum,key)
 			
 			// Append the rest of the packet.
 			d.WriteTo(mb)
 			
-			// Forward the packet to the other node.
-			w.SendTo(mlst.ST_BestFit,node,mb.Bytes())
+			// Forward the packet to the other node. It responds in our place.
+			err := w.SendTo(mlst.ST_BestFit,node,mb.Bytes())
+			if err==nil {
+				w.Log.Debug("redirect forwarded","key",key,"target",target)
+				fsp.Finish()
+				return
+			}
+			w.Log.Warn("redirect forward failed","key",key,"target",target,"err",err)
+			if fsp!=nil { fsp.SetAttr("error",err.Error()) }
+			fsp.Finish()
+			resp = RESP_DeadTargetNode
+		case META_Tombstone:
+			// Replicated reads compare the version of the tombstone.
+			resp = RESP_NotFound
+			if withVersion { resp = RESP_Deleted }
 		default: break
 		}
 	} else if ierr==badger.ErrKeyNotFound {
 		resp = RESP_NotFound
 	} else {
+		w.Log.Error("get failed","key",key,"err",ierr)
+		ioError(w,"get")
 		resp = RESP_IoError
 	}
 	
 	target,err = d.DecodeString()
-	if err!=nil { return }
+	if err!=nil { w.Log.Debug("malformed MH_Get","err",err); return }
 	
 	node := w.Lookup(target)
-	if node==nil { return }
+	if node==nil {
+		w.Log.Debug("get response dropped","reason","unknown-requester","target",target)
+		return
+	}
 	
 	targid,err := d.DecodeUint64()
-	if err!=nil { return }
+	if err!=nil { w.Log.Debug("malformed MH_Get","err",err); return }
 	
 	
-	mb := new(mlst.MessageBuffer).Init()
+	mb := w.NewMessage()
 restart:
 	
 	// Write the header
@@ -213,15 +447,31 @@ restart:
 	
 	switch resp {
 	case RESP_OK:
-		ierr = item.Value(func(b []byte) error {
-			mb.EncodeBytes(b)
-			return nil
-		})
-		if ierr!=nil {
+		val,version,verr := itemValue(item)
+		if verr!=nil {
+			w.Log.Error("get failed","key",key,"err",verr)
+			ioError(w,"get")
+			ierr = verr
+			resp = RESP_IoError
+			mb.Reset()
+			goto restart
+		}
+		if withVersion {
+			mb.EncodeMulti(val,version,item.ExpiresAt())
+		} else {
+			mb.EncodeBytes(val)
+		}
+	case RESP_Deleted:
+		_,version,verr := itemValue(item)
+		if verr!=nil {
+			w.Log.Error("get failed","key",key,"err",verr)
+			ioError(w,"get")
+			ierr = verr
 			resp = RESP_IoError
 			mb.Reset()
 			goto restart
 		}
+		mb.EncodeMulti(version,item.ExpiresAt())
 	case RESP_IoError:
 		ierr = unwrapCause(ierr)
 		mb.EncodeString(ierr.Error())
@@ -231,119 +481,109 @@ restart:
 }
 func (s *Store) Get(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) bool {
 	mlst.RetainBinary(d)
-	go s.i_Get(w,d,msg)
+	go s.i_Get(w,d,msg,false)
+	return false
+}
+func (s *Store) GetVersioned(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) bool {
+	mlst.RetainBinary(d)
+	go s.i_Get(w,d,msg,true)
 	return false
 }
 
-func (s *Store) i_PutResponse(w *mlst.WrapNode, target string,targid uint64,resp int,add ...interface{}) {
+func (s *Store) i_Respond(w *mlst.WrapNode, header uint64, target string,targid uint64,resp int,add ...interface{}) {
 	node := w.Lookup(target)
-	if node==nil { return }
+	if node==nil {
+		w.Log.Debug("response dropped","reason","unknown-requester","header",mlst.Hex(header),"target",target)
+		return
+	}
 	
-	mb := new(mlst.MessageBuffer).Init()
-	mb.EncodeMulti(MH_GetResponse,targid,resp)
+	mb := w.NewMessage()
+	mb.EncodeMulti(header,targid,resp)
 	if len(add)!=0 { mb.EncodeMulti(add...) }
 	w.SendTo(mlst.ST_BestFit,node,mb.Bytes())
 }
+/*
+MH_Put has always been answered with MH_GetResponse. Existing clients rely on it.
+*/
+func (s *Store) i_PutResponse(w *mlst.WrapNode, target string,targid uint64,resp int,add ...interface{}) {
+	s.i_Respond(w,MH_GetResponse,target,targid,resp,add...)
+}
 func (s *Store) i_Put(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) {
-	defer msg.Free()
+	defer d.Release(msg)
 	hashnum,err := d.DecodeInt()
-	if err!=nil { return }
+	if err!=nil { w.Log.Debug("malformed MH_Put","err",err); return }
 	
 	meta,err := d.DecodeUint8()
-	if err!=nil { return }
+	if err!=nil { w.Log.Debug("malformed MH_Put","err",err); return }
 	
 	expiresAt,err := d.DecodeUint64()
-	if err!=nil { return }
+	if err!=nil { w.Log.Debug("malformed MH_Put","err",err); return }
 	
 	key,err := d.DecodeBytes()
-	if err!=nil { return }
+	if err!=nil { w.Log.Debug("malformed MH_Put","err",err); return }
 	
 	value,err := d.DecodeBytes()
-	if err!=nil { return }
+	if err!=nil { w.Log.Debug("malformed MH_Put","err",err); return }
 	
 	// --------------------------------------------------
 	
 	target,err := d.DecodeString()
-	if err!=nil { return }
+	if err!=nil { w.Log.Debug("malformed MH_Put","err",err); return }
 	
 	targid,err := d.DecodeUint64()
-	if err!=nil { return }
+	if err!=nil { w.Log.Debug("malformed MH_Put","err",err); return }
 	
 	// --------------------------------------------------
 	
-	l := len(s.Data)
-	f := len(s.Freespace)
-	pos_1 := modulo(hashnum,l)
-	pos_2 := pos_1
+	sp := w.Tracer.Start(d,"db put")
+	defer sp.Finish()
+	
+	if meta==META_Versioned || meta==META_Tombstone {
+		// Replicated write or delete. putVersioned takes the key lock itself.
+		s.i_PutVersioned(w,hashnum,&badger.Entry{Key:key,Value:value,UserMeta:meta,ExpiresAt:expiresAt},target,targid)
+		return
+	}
+	
+	// Keep the put from landing between the check and the write of a CondPut or Update.
+	m := s.klck.lock(key)
+	defer m.Unlock()
 	
-	var hfs bool
 	rawdata := true
 	switch meta {
 	case META_Raw: break
-	case META_OuterRedirect: hfs,rawdata = true,false // Just drop the redirect message.
+	case META_OuterRedirect:
+		// Don't resurrect deleted keys.
+		if s.tombstoned(hashnum,key) {
+			w.Log.Debug("put rejected","reason","tombstone","key",key)
+			s.i_PutResponse(w,target,targid,RESP_Deleted)
+			return
+		}
+		rawdata = false // Just drop the redirect message.
 	default:
 		// Illegal message type, abort.
+		w.Log.Debug("put rejected","reason","illegal-meta","meta",meta,"key",key)
 		s.i_PutResponse(w,target,targid,RESP_Illegal)
 		return
 	}
-	if !hfs {
-		var fs Freespace
-		if pos_2<f { fs = s.Freespace[pos_2] }
-		hfs = s.Data[pos_2]!=nil
-		if fs!=nil && hfs { hfs = fs.HasFreeSpace(len(key),len(value)) }
-	}
-	if !hfs {
-		for i := 0 ; i<l; i++ {
-			var fs Freespace
-			if i<f { fs = s.Freespace[i] }
-			hfs = s.Data[i]!=nil
-			if fs!=nil && hfs { hfs = fs.HasFreeSpace(len(key),len(value)) }
-			if hfs {
-				pos_2 = i
-				break
-			}
-		}
-	}
-	if !hfs {
-		s.i_PutResponse(w,target,targid,RESP_IoError,"No Disk Space")
+	pl,ok := s.place(hashnum,rawdata,&badger.Entry{Key:key,Value:value,UserMeta:meta,ExpiresAt:expiresAt})
+	if !ok {
+		w.Log.Error("put failed","key",key,"err","No Disk Space")
+		w.Metrics.Counter("cherdy_db_no_space_total","Puts, rejected because no shard had free space.").Inc()
+		s.i_PutResponse(w,target,targid,RESP_IoError,ErrNoSpace.Error())
 		return
 	}
-	var wg sync.WaitGroup
-	var reterr error
-	CB := errsetter(&wg,&reterr)
-	
-	store := s.Data[pos_2]
-	if store==nil { store = s.Redirects }
-	if pos_2<f && store!=s.Redirects && !rawdata {
-		f := s.Freespace[pos_2]
-		if f!=nil {
-			if !f.HasFreeSpace(len(key),len(value)) { store = s.Redirects }
-		}
-	}
-	db_put(store,&badger.Entry{Key:key,Value:value,UserMeta:meta,ExpiresAt:expiresAt},CB)
-	
-	/*
-	If we have put our data into a bucket != the specified target, we need to put a hint into
-	the destination or redirect bucket, that points to the choosen destination.
-	*/
-	if pos_1!=pos_2 && store!=s.Redirects {
-		data,_ := msgpack.Marshal(pos_2)
-		
-		store = s.Data[pos_1]
-		if store==nil { store = s.Redirects }
-		db_put(store,&badger.Entry{Key:key,Value:data,UserMeta:META_InnerRedirect,ExpiresAt:expiresAt},CB)
-	}
-	
-	wg.Wait()
+	if pl.hint!=nil { w.Log.Debug("put redirected","key",key,"from",pl.pos_1,"to",pl.pos_2) }
 	
+	reterr := s.write(pl)
 	if reterr!=nil {
-		s.i_PutResponse(w,target,targid,RESP_IoError,reterr.Error())
+		w.Log.Error("put failed","key",key,"err",reterr)
+		ioError(w,"put")
+		s.i_PutResponse(w,target,targid,RESP_IoError,unwrapCause(reterr).Error())
 	} else {
 		s.i_PutResponse(w,target,targid,RESP_OK)
 	}
 	
-	if pos_1<f { freespacetouch(s.Freespace[pos_1]) }
-	if pos_1!=pos_2 && pos_2<f { freespacetouch(s.Freespace[pos_2]) }
+	s.touch(pl)
 }
 func (s *Store) Put(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) bool {
 	mlst.RetainBinary(d)
@@ -352,8 +592,42 @@ func (s *Store) Put(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary
 }
 
 func (s *Store) Attach(wn *mlst.WrapNode) {
+	wn.Deleg.AsyncHooks = append(wn.Deleg.AsyncHooks,hintHooks{s,wn})
 	wn.Handlers[MH_Get] = s.Get
+	wn.Handlers[MH_GetVersioned] = s.GetVersioned
 	wn.Handlers[MH_Put] = s.Put
+	wn.Handlers[MH_Delete] = s.Delete
+	wn.Handlers[MH_MultiGet] = s.MultiGet
+	wn.Handlers[MH_MultiPut] = s.MultiPut
+	wn.Handlers[MH_Scan] = s.Scan
+	wn.Handlers[MH_CondPut] = s.CondPut
+	wn.Handlers[MH_Update] = s.Update
+	wn.Handlers[MH_ReplPut] = s.ReplPut
+	wn.Handlers[MH_ReplGet] = s.ReplGet
+	wn.Handlers[MH_ReplDelete] = s.ReplDelete
+	wn.Handlers[MH_AESync] = s.AESync
+	wn.Handlers[MH_AEPull] = s.AEPull
+	wn.Handlers[MH_GetResponse] = wn.Calls.Chain(wn.Handlers[MH_GetResponse])
+	wn.Handlers[MH_PutResponse] = wn.Calls.Chain(wn.Handlers[MH_PutResponse])
+	wn.Handlers[MH_DeleteResponse] = wn.Calls.Chain(wn.Handlers[MH_DeleteResponse])
+	wn.Handlers[MH_MultiGetResponse] = wn.Calls.Chain(wn.Handlers[MH_MultiGetResponse])
+	wn.Handlers[MH_MultiPutResponse] = wn.Calls.Chain(wn.Handlers[MH_MultiPutResponse])
+	wn.Handlers[MH_ScanResponse] = wn.Calls.Chain(wn.Handlers[MH_ScanResponse])
+	wn.Handlers[MH_UpdateResponse] = wn.Calls.Chain(wn.Handlers[MH_UpdateResponse])
+	wn.Handlers[MH_AESyncResponse] = wn.Calls.Chain(wn.Handlers[MH_AESyncResponse])
+	wn.SetPriority(MH_GetResponse,mlst.PrioControl)
+	wn.SetPriority(MH_PutResponse,mlst.PrioControl)
+	wn.SetPriority(MH_DeleteResponse,mlst.PrioControl)
+	wn.SetPriority(MH_MultiGetResponse,mlst.PrioControl)
+	wn.SetPriority(MH_MultiPutResponse,mlst.PrioControl)
+	wn.SetPriority(MH_ScanResponse,mlst.PrioControl)
+	wn.SetPriority(MH_UpdateResponse,mlst.PrioControl)
+	wn.SetPriority(MH_AESyncResponse,mlst.PrioControl)
+	wn.SetPriority(MH_MultiGet,mlst.PrioBulk)
+	wn.SetPriority(MH_MultiPut,mlst.PrioBulk)
+	wn.SetPriority(MH_Scan,mlst.PrioBulk)
+	wn.SetPriority(MH_AESync,mlst.PrioBulk)
+	wn.SetPriority(MH_AEPull,mlst.PrioBulk)
 }
 
 
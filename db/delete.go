@@ -0,0 +1,219 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package db
+
+import (
+	"github.com/dgraph-io/badger"
+	"github.com/byte-mug/cherdy/mlst"
+	"github.com/byte-mug/golibs/bufferex"
+	
+	"sync"
+	"time"
+)
+
+/*
+Tombstones are kept this long, unless Store.TombstoneTTL says otherwise.
+*/
+const DefaultTombstoneTTL = time.Hour*24
+
+func (s *Store) tombstoneTTL() time.Duration {
+	if s.TombstoneTTL<=0 { return DefaultTombstoneTTL }
+	return s.TombstoneTTL
+}
+
+func db_delete(db *badger.DB,key []byte,f func(error)) {
+	tx := db.NewTransaction(true)
+	defer tx.CommitWith(f)
+	tx.Delete(key)
+}
+
+/*
+Returns true, if the home shard of the key contains a tombstone.
+*/
+func (s *Store) tombstoned(hashnum int, key []byte) bool {
+	item,err := db_get(s.home(hashnum),key)
+	if err!=nil { return false }
+	defer item.Discard()
+	return item.UserMeta()==META_Tombstone
+}
+
+/*
+An entry of a key, found by locate.
+*/
+type located struct{
+	db   *badger.DB
+	meta byte
+	val  []byte
+}
+
+/*
+Finds all entries of a key, following META_InnerRedirect hints. The last entry
+is the one, that Get would return.
+*/
+func (s *Store) locate(hashnum int, key []byte) (ls []located,err error) {
+	err = s.follow(hashnum,func(shard *badger.DB) ([]byte,bool,error) {
+		var next *located
+		for _,db := range [2]*badger.DB{shard,s.Redirects} {
+			item,ierr := db_get(db,key)
+			if ierr==badger.ErrKeyNotFound { continue }
+			if ierr!=nil { return nil,false,ierr }
+			e := located{db:db,meta:item.UserMeta()}
+			e.val,ierr = item.ValueCopy(nil)
+			item.Discard()
+			if ierr!=nil { return nil,false,ierr }
+			ls = append(ls,e)
+			if next==nil { next = &ls[len(ls)-1] }
+		}
+		if next==nil || next.meta!=META_InnerRedirect { return nil,false,nil }
+		return next.val,true,nil
+	})
+	return
+}
+
+/*
+Returns the highest version of the entries of a key, including it's tombstone.
+*/
+func lastVersion(ls []located) (v uint64) {
+	for _,e := range ls {
+		var ev uint64
+		switch e.meta {
+		case META_Versioned: ev,_,_ = unversion(e.val)
+		case META_Tombstone: ev,_ = tombVersion(e.val)
+		}
+		if ev>v { v = ev }
+	}
+	return
+}
+
+/*
+Removes all entries and hints of the key and puts a tombstone with the given version
+into the home shard, so a late redirect or an older replicated write doesn't resurrect
+the key. The caller must hold the lock of the key. found is true, if the key had a
+value. outer is the node of a META_OuterRedirect entry.
+*/
+func (s *Store) tombstone(hashnum int, key []byte, ls []located, version, expiresAt uint64) (found bool, outer string, reterr error) {
+	var wg sync.WaitGroup
+	CB := errsetter(&wg,&reterr)
+	
+	home := s.home(hashnum)
+	deleted := make(map[*badger.DB]bool)
+	for _,e := range ls {
+		switch e.meta {
+		case META_Tombstone: continue
+		case META_OuterRedirect: outer = string(e.val)
+		case META_InnerRedirect:
+		default: found = true
+		}
+		if e.db==home || deleted[e.db] { continue }
+		deleted[e.db] = true
+		wg.Add(1)
+		db_delete(e.db,key,CB)
+	}
+	if home!=nil {
+		wg.Add(1)
+		db_put(home,&badger.Entry{Key:key,Value:versioned(version,nil),UserMeta:META_Tombstone,ExpiresAt:expiresAt},CB)
+	}
+	wg.Wait()
+	return
+}
+
+func (s *Store) i_Delete(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) {
+	defer d.Release(msg)
+	hashnum,err := d.DecodeInt()
+	if err!=nil { w.Log.Debug("malformed MH_Delete","err",err); return }
+	
+	key,err := d.DecodeBytes()
+	if err!=nil { w.Log.Debug("malformed MH_Delete","err",err); return }
+	
+	target,err := d.DecodeString()
+	if err!=nil { w.Log.Debug("malformed MH_Delete","err",err); return }
+	
+	targid,err := d.DecodeUint64()
+	if err!=nil { w.Log.Debug("malformed MH_Delete","err",err); return }
+	
+	sp := w.Tracer.Start(d,"db delete")
+	defer sp.Finish()
+	
+	m := s.klck.lock(key)
+	defer m.Unlock()
+	
+	ls,err := s.locate(hashnum,key)
+	if err!=nil {
+		w.Log.Error("delete failed","key",key,"err",err)
+		ioError(w,"delete")
+		s.i_Respond(w,MH_DeleteResponse,target,targid,RESP_IoError,unwrapCause(err).Error())
+		return
+	}
+	
+	expiresAt := uint64(time.Now().Add(s.tombstoneTTL()).Unix())
+	found,outer,reterr := s.tombstone(hashnum,key,ls,nextVersion(lastVersion(ls)),expiresAt)
+	if reterr!=nil {
+		w.Log.Error("delete failed","key",key,"err",reterr)
+		ioError(w,"delete")
+		s.i_Respond(w,MH_DeleteResponse,target,targid,RESP_IoError,unwrapCause(reterr).Error())
+		return
+	}
+	
+	if outer!="" {
+		node := w.Lookup(outer)
+		if node==nil {
+			w.Log.Warn("redirect target is dead","key",key,"target",outer)
+			s.i_Respond(w,MH_DeleteResponse,target,targid,RESP_DeadTargetNode)
+			return
+		}
+		
+		// If the sender has already given up, don't forward.
+		if d.Context().Err()!=nil {
+			w.Log.Debug("redirect discarded","reason","deadline","key",key,"target",outer)
+			return
+		}
+		
+		fsp := w.Tracer.Start(d,"redirect forward")
+		if fsp!=nil { fsp.SetAttr("to",outer) }
+		defer fsp.Finish()
+		
+		// Forward the request. The other node responds.
+		mb := w.NewMessage()
+		mb.EncodeEnvelope(d)
+		mb.EncodeMulti(MH_Delete,hashnum,key,target,targid)
+		w.Log.Debug("redirect forwarded","key",key,"target",outer)
+		if err := w.SendTo(mlst.ST_BestFit,node,mb.Bytes()); err!=nil {
+			w.Log.Warn("redirect forward failed","key",key,"target",outer,"err",err)
+			s.i_Respond(w,MH_DeleteResponse,target,targid,RESP_DeadTargetNode)
+		}
+		return
+	}
+	
+	if found {
+		s.i_Respond(w,MH_DeleteResponse,target,targid,RESP_OK)
+	} else {
+		s.i_Respond(w,MH_DeleteResponse,target,targid,RESP_NotFound)
+	}
+}
+func (s *Store) Delete(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) bool {
+	mlst.RetainBinary(d)
+	go s.i_Delete(w,d,msg)
+	return false
+}
+
@@ -0,0 +1,53 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package db
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDelete(t *testing.T) {
+	c,ss := stores(t,2,0)
+	ss[0].TombstoneTTL = time.Hour
+	w := c.Nodes[1]
+	k := []byte("key")
+	expect(t,call(t,w,"node-0",MH_Put,1,META_Raw,0,k,[]byte("v1")),"[0]")
+	expect(t,call(t,w,"node-0",MH_Get,1,k),"[0 v1]")
+	expect(t,call(t,w,"node-0",MH_Delete,1,k),"[0]")
+	expect(t,call(t,w,"node-0",MH_Get,1,k),"[1]")
+	expect(t,call(t,w,"node-0",MH_Delete,1,k),"[1]")
+	expect(t,call(t,w,"node-0",MH_Delete,1,[]byte("other")),"[1]")
+	
+	// The tombstone is versioned and expires after TombstoneTTL.
+	got := fields(call(t,w,"node-0",MH_GetVersioned,1,k))
+	if len(got)!=3 || got[0]!="5" || got[1]=="0" { t.Fatalf("versioned get of a tombstone: %v",got) }
+	exp := time.Now().Add(time.Hour).Unix()
+	if at := got[2]; at<fmt.Sprint(exp-10) || at>fmt.Sprint(exp) { t.Fatalf("tombstone expires at %s, want about %d",at,exp) }
+	
+	// A put replaces the tombstone.
+	expect(t,call(t,w,"node-0",MH_Put,1,META_Raw,0,k,[]byte("v2")),"[0]")
+	expect(t,call(t,w,"node-0",MH_Get,1,k),"[0 v2]")
+}
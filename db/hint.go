@@ -0,0 +1,258 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package db
+
+import (
+	"github.com/dgraph-io/badger"
+	"github.com/byte-mug/cherdy/mlst"
+	"github.com/hashicorp/memberlist"
+	
+	"bytes"
+	"context"
+	"github.com/vmihailenco/msgpack"
+	"sync"
+	"time"
+)
+
+/*
+Hinted handoff: if a replicated write or delete can't be delivered to an owner,
+because it is dead or unreachable, the coordinator keeps it as a hint for that owner.
+The hints of an owner are replayed, when it (re-)joins the cluster, and periodically
+by StartHintReplay, for owners, that stayed members while they were unreachable.
+Hints expire after Replication.HintTTL.
+
+Hints are stored as META_Hint entries in the dedicated Store.Hints DB, with the key
+
+	owner + "\x00" + key
+
+If Store.Hints is nil, hinted handoff is disabled. Hinted writes don't count towards
+the write quorum. A replayed hint is applied like any other replicated write, so the
+owner drops it, if it has a newer value or tombstone meanwhile.
+*/
+
+const DefaultHintTTL = time.Hour*3
+
+/*
+The value of a hint.
+*/
+type hint struct{
+	Hashnum   int
+	ExpiresAt uint64
+	Version   uint64
+	Data      []byte // The META_Versioned value or the META_Tombstone.
+	Meta      byte
+}
+
+func (r *Replication) hintTTL() time.Duration {
+	if r.HintTTL<=0 { return DefaultHintTTL }
+	return r.HintTTL
+}
+
+func hintKey(owner string, key []byte) []byte {
+	return append([]byte(owner+"\x00"),key...)
+}
+
+/*
+Stores a hint for owner, unless it already has a newer one for the key.
+*/
+func (s *Store) storeHint(owner string, hashnum int, ent *badger.Entry) error {
+	version,_,err := unversion(ent.Value)
+	if err!=nil { return err }
+	
+	data,err := msgpack.Marshal(&hint{hashnum,ent.ExpiresAt,version,ent.Value,ent.UserMeta})
+	if err!=nil { return err }
+	
+	expiresAt := uint64(time.Now().Add(s.Repl.hintTTL()).Unix())
+	if ent.ExpiresAt!=0 && ent.ExpiresAt<expiresAt { expiresAt = ent.ExpiresAt }
+	
+	hk := hintKey(owner,ent.Key)
+	return s.Hints.Update(func(tx *badger.Txn) error {
+		if item,err := tx.Get(hk); err==nil {
+			var old hint
+			if item.Value(func(b []byte) error { return msgpack.Unmarshal(b,&old) })==nil && old.Version>=version { return nil }
+		}
+		return tx.SetEntry(&badger.Entry{Key:hk,Value:data,UserMeta:META_Hint,ExpiresAt:expiresAt})
+	})
+}
+
+func (s *Store) hint(w *mlst.WrapNode, owner string, hashnum int, ent *badger.Entry) {
+	if s.Hints==nil { return } // Disabled.
+	if err := s.storeHint(owner,hashnum,ent); err!=nil {
+		w.Log.Error("hint failed","key",ent.Key,"owner",owner,"err",err)
+		ioError(w,"hint")
+		return
+	}
+	w.Log.Debug("hint stored","key",ent.Key,"owner",owner)
+	w.Metrics.Counter("cherdy_db_hints_total","Hinted handoff activity by event.","event","stored").Inc()
+}
+
+/*
+Delivers all hints for node and deletes the delivered ones.
+*/
+func (s *Store) ReplayHints(w *mlst.WrapNode, node *memberlist.Node) {
+	db := s.Hints
+	if db==nil { return }
+	
+	// A join and the timer may replay at the same time.
+	s.hlck.Lock()
+	defer s.hlck.Unlock()
+	
+	type pending struct{
+		key []byte
+		h   hint
+	}
+	var ps []pending
+	prefix := hintKey(node.Name,nil)
+	err := db.View(func(tx *badger.Txn) error {
+		opt := badger.DefaultIteratorOptions
+		opt.Prefix = prefix
+		it := tx.NewIterator(opt)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			if item.UserMeta()!=META_Hint { continue }
+			p := pending{key:item.KeyCopy(nil)}
+			if err := item.Value(func(b []byte) error { return msgpack.Unmarshal(b,&p.h) }); err!=nil {
+				w.Log.Debug("malformed hint","key",p.key,"err",err)
+				continue
+			}
+			ps = append(ps,p)
+		}
+		return nil
+	})
+	if err!=nil {
+		w.Log.Error("hint replay failed","owner",node.Name,"err",err)
+		ioError(w,"hint")
+		return
+	}
+	if len(ps)==0 { return }
+	w.Log.Info("replaying hints","owner",node.Name,"count",len(ps))
+	
+	nodes := []*memberlist.Node{node}
+	for _,p := range ps {
+		key := p.key[len(prefix):]
+		acks := gather(w,nodes,1,s.Repl.timeout(context.Background()),func(id uint64) []byte {
+			mb := w.NewMessage()
+			mb.EncodeMulti(MH_Put,p.h.Hashnum,p.h.Meta,p.h.ExpiresAt,key,p.h.Data,w.Name,id)
+			return mb.Bytes()
+		},func(i int, r *mlst.Reply) bool {
+			resp,err := r.DecodeInt()
+			return err==nil && resp==RESP_OK
+		},nil)
+		if acks==0 {
+			// The owner is gone again. Keep the remaining hints for the next join.
+			w.Log.Warn("hint replay failed","owner",node.Name,"key",key)
+			w.Metrics.Counter("cherdy_db_hints_total","Hinted handoff activity by event.","event","failed").Inc()
+			return
+		}
+		w.Metrics.Counter("cherdy_db_hints_total","Hinted handoff activity by event.","event","replayed").Inc()
+		
+		// Delete the hint, unless it has been replaced by a newer one meanwhile.
+		err := db.Update(func(tx *badger.Txn) error {
+			item,err := tx.Get(p.key)
+			if err!=nil { return nil }
+			var cur hint
+			if item.Value(func(b []byte) error { return msgpack.Unmarshal(b,&cur) })==nil && cur.Version>p.h.Version { return nil }
+			return tx.Delete(p.key)
+		})
+		if err!=nil {
+			w.Log.Error("hint delete failed","key",p.key,"err",err)
+			ioError(w,"hint")
+		}
+	}
+}
+
+/*
+Returns the owners, that have hints.
+*/
+func (s *Store) hintOwners() (names []string,err error) {
+	err = s.Hints.View(func(tx *badger.Txn) error {
+		opt := badger.DefaultIteratorOptions
+		opt.PrefetchValues = false
+		it := tx.NewIterator(opt)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); {
+			k := it.Item().Key()
+			i := bytes.IndexByte(k,0)
+			if i<0 { it.Next(); continue }
+			names = append(names,string(k[:i]))
+			
+			// Skip the other hints of the owner.
+			it.Seek(append(append([]byte{},k[:i]...),1))
+		}
+		return nil
+	})
+	return
+}
+
+/*
+Replays the hints of all owners, that are alive.
+*/
+func (s *Store) ReplayAllHints(w *mlst.WrapNode) error {
+	if s.Hints==nil { return nil }
+	names,err := s.hintOwners()
+	if err!=nil { return err }
+	for _,name := range names {
+		if node := w.Lookup(name); node!=nil && name!=w.Name { s.ReplayHints(w,node) }
+	}
+	return nil
+}
+
+/*
+Runs ReplayAllHints every interval. Call the returned function to stop it.
+*/
+func (s *Store) StartHintReplay(w *mlst.WrapNode, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var once sync.Once
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done: return
+			case <-t.C:
+			}
+			if err := s.ReplayAllHints(w); err!=nil {
+				w.Log.Error("hint replay failed","err",err)
+				ioError(w,"hint")
+			}
+		}
+	}()
+	return func() { once.Do(func() { close(done) }) }
+}
+
+/*
+Replays the hints of nodes, that join the cluster.
+*/
+type hintHooks struct{
+	s *Store
+	w *mlst.WrapNode
+}
+func (h hintHooks) NotifyJoin(node *memberlist.Node) {
+	if node.Name==h.w.Name { return }
+	h.s.ReplayHints(h.w,node)
+}
+func (h hintHooks) NotifyLeave(node *memberlist.Node) {}
+func (h hintHooks) NotifyUpdate(node *memberlist.Node) {}
+
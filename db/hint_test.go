@@ -0,0 +1,98 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package db
+
+import (
+	"errors"
+	"github.com/byte-mug/cherdy/mlst"
+	"github.com/hashicorp/memberlist"
+	"testing"
+	"time"
+)
+
+/*
+Makes node-2 unreachable for replicated writes of node-0, while it stays a member.
+*/
+func unreachable(w *mlst.WrapNode, on bool) {
+	if !on {
+		w.SetInterceptor(nil)
+		return
+	}
+	w.SetInterceptor(func(st mlst.SendType,to *memberlist.Node, msg []byte, send mlst.SendFunc) error {
+		if to.Name=="node-2" { return errors.New("unreachable") }
+		return send(st,to,msg)
+	})
+}
+
+func TestHintReplay(t *testing.T) {
+	c,ss := stores(t,3,3)
+	for _,s := range ss { s.Repl.RepairRate = -1 }
+	w := c.Nodes[0]
+	k := []byte("key")
+	
+	unreachable(w,true)
+	r := fields(call(t,w,"node-0",MH_ReplPut,0,k,[]byte("v1"),0))
+	if r[0]!="0" || r[2]!="2" { t.Fatalf("replicated put: %v",r) }
+	owners,err := ss[0].hintOwners()
+	if err!=nil || len(owners)!=1 || owners[0]!="node-2" { t.Fatalf("hint owners %v %v",owners,err) }
+	
+	// The replay fails, as long as node-2 can't be reached. The hint is kept.
+	if err = ss[0].ReplayAllHints(w); err!=nil { t.Fatal(err) }
+	if owners,_ = ss[0].hintOwners(); len(owners)!=1 { t.Fatal("a failed replay deleted the hint") }
+	
+	unreachable(w,false)
+	if err = ss[0].ReplayAllHints(w); err!=nil { t.Fatal(err) }
+	converge(t,c,k,3,"[0 v1 "+r[1]+" ")
+	if owners,_ = ss[0].hintOwners(); len(owners)!=0 { t.Fatalf("hints left for %v",owners) }
+	
+	// Deletes are hinted as well. Only the newest hint of a key is kept.
+	unreachable(w,true)
+	fields(call(t,w,"node-0",MH_ReplPut,0,k,[]byte("v2"),0))
+	r = fields(call(t,w,"node-0",MH_ReplDelete,k,0))
+	if r[0]!="0" { t.Fatalf("replicated delete: %v",r) }
+	unreachable(w,false)
+	hintHooks{ss[0],w}.NotifyJoin(w.Lookup("node-2"))
+	converge(t,c,k,3,"[5 "+r[1]+" ")
+}
+
+func TestHintTimer(t *testing.T) {
+	c,ss := stores(t,3,3)
+	w := c.Nodes[0]
+	unreachable(w,true)
+	r := fields(call(t,w,"node-0",MH_ReplPut,0,[]byte("key"),[]byte("v1"),0))
+	unreachable(w,false)
+	stop := ss[0].StartHintReplay(w,time.Millisecond*50)
+	defer stop()
+	converge(t,c,[]byte("key"),3,"[0 v1 "+r[1]+" ")
+	
+	stop()
+	
+	// Without a Hints DB, nothing is kept.
+	ss[0].Hints = nil
+	unreachable(w,true)
+	call(t,w,"node-0",MH_ReplPut,0,[]byte("other"),[]byte("v1"),0)
+	unreachable(w,false)
+	if err := ss[0].ReplayAllHints(w); err!=nil { t.Fatal(err) }
+	expect(t,replicas(t,c,0,[]byte("other"))[2],"[1]")
+}
@@ -0,0 +1,178 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package db
+
+import (
+	"github.com/byte-mug/cherdy/mlst"
+	"github.com/byte-mug/golibs/bufferex"
+	"github.com/hashicorp/memberlist"
+	
+	"bytes"
+)
+
+/*
+Consistency levels of a replicated read:
+
+	MH_ReplGet, key, consistency, target, targid
+
+The coordinator asks all owners of the key with MH_GetVersioned and waits for the
+replies of one, a majority or all of them. The response is
+
+	MH_GetResponse, targid, RESP_OK, value, version, replies, divergent
+	MH_GetResponse, targid, RESP_NotFound, replies, divergent
+	MH_GetResponse, targid, RESP_QuorumFailed, replies
+
+The newest version wins. A key, whose newest entry is a tombstone, is reported as
+RESP_NotFound. divergent is true, if the replies didn't agree.
+*/
+const (
+	CL_One = iota
+	CL_Quorum
+	CL_All
+)
+
+func readQuorum(cl, n int) int {
+	switch cl {
+	case CL_One: return 1
+	case CL_All: return n
+	}
+	return n/2+1
+}
+
+/*
+The reply of one replica to a replicated read.
+*/
+type replica struct{
+	node      *memberlist.Node
+	ok        bool // The replica replied.
+	resp      int
+	value     []byte
+	version   uint64
+	expiresAt uint64
+}
+
+/*
+Returns the index of the newest value or tombstone or -1, if no replica has the key.
+A tombstone wins over a value of the same version. Unversioned entries have version
+0. divergent is true, if any replica, that replied, has another version or value.
+*/
+func newest(rs []replica) (win int,divergent bool) {
+	win = -1
+	for i,r := range rs {
+		if !r.ok || r.resp==RESP_NotFound { continue }
+		switch {
+		case win<0,r.version>rs[win].version: win = i
+		case r.version==rs[win].version && r.resp==RESP_Deleted: win = i
+		}
+	}
+	if win<0 { return }
+	w := &rs[win]
+	for _,r := range rs {
+		if !r.ok { continue }
+		if r.resp!=w.resp || r.version!=w.version || !bytes.Equal(r.value,w.value) { divergent = true }
+	}
+	return
+}
+
+func (s *Store) i_ReplGet(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) {
+	defer d.Release(msg)
+	key,err := d.DecodeBytes()
+	if err!=nil { w.Log.Debug("malformed MH_ReplGet","err",err); return }
+	
+	cl,err := d.DecodeInt()
+	if err!=nil { w.Log.Debug("malformed MH_ReplGet","err",err); return }
+	
+	target,err := d.DecodeString()
+	if err!=nil { w.Log.Debug("malformed MH_ReplGet","err",err); return }
+	
+	targid,err := d.DecodeUint64()
+	if err!=nil { w.Log.Debug("malformed MH_ReplGet","err",err); return }
+	
+	if s.Repl.Ring==nil {
+		w.Log.Debug("replicated get rejected","reason","no-ring","key",key)
+		s.i_Respond(w,MH_GetResponse,target,targid,RESP_Illegal)
+		return
+	}
+	
+	sp := w.Tracer.Start(d,"db repl-get")
+	defer sp.Finish()
+	
+	hashnum := s.Repl.Ring.KeyHashnum(key)
+	nodes := owners(w,s.Repl.Ring.KeyOwners(key))
+	k := readQuorum(cl,len(nodes))
+	rs := make([]replica,len(nodes))
+	
+	n := gather(w,nodes,k,s.Repl.timeout(d.Context()),func(id uint64) []byte {
+		mb := w.NewMessage()
+		mb.EncodeSpan(sp)
+		mb.EncodeMulti(MH_GetVersioned,hashnum,key,w.Name,id)
+		return mb.Bytes()
+	},func(i int, r *mlst.Reply) bool {
+		rp := replica{node:nodes[i]}
+		resp,err := r.DecodeInt()
+		if err!=nil { return false }
+		switch resp {
+		case RESP_OK:
+			if rp.value,err = r.DecodeBytes(); err!=nil { return false }
+			if rp.version,err = r.DecodeUint64(); err!=nil { return false }
+			if rp.expiresAt,err = r.DecodeUint64(); err!=nil { return false }
+		case RESP_Deleted:
+			if rp.version,err = r.DecodeUint64(); err!=nil { return false }
+			if rp.expiresAt,err = r.DecodeUint64(); err!=nil { return false }
+		case RESP_NotFound: break
+		default: return false
+		}
+		rp.ok,rp.resp = true,resp
+		rs[i] = rp
+		return true
+	},nil)
+	if sp!=nil { sp.SetAttr("replies",n) }
+	
+	if n<k {
+		w.Log.Warn("replicated get failed","key",key,"replies",n,"quorum",k,"owners",len(nodes))
+		w.Metrics.Counter("cherdy_db_repl_reads_total","Replicated reads by result.","result","quorum-failed").Inc()
+		s.i_Respond(w,MH_GetResponse,target,targid,RESP_QuorumFailed,n)
+		return
+	}
+	
+	win,divergent := newest(rs)
+	if divergent && win>=0 { s.readRepair(w,hashnum,key,rs,win) }
+	if divergent {
+		w.Log.Debug("replicas diverge","key",key)
+		w.Metrics.Counter("cherdy_db_repl_reads_total","Replicated reads by result.","result","divergent").Inc()
+	} else {
+		w.Metrics.Counter("cherdy_db_repl_reads_total","Replicated reads by result.","result","ok").Inc()
+	}
+	if win<0 || rs[win].resp==RESP_Deleted {
+		s.i_Respond(w,MH_GetResponse,target,targid,RESP_NotFound,n,divergent)
+		return
+	}
+	s.i_Respond(w,MH_GetResponse,target,targid,RESP_OK,rs[win].value,rs[win].version,n,divergent)
+}
+func (s *Store) ReplGet(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) bool {
+	mlst.RetainBinary(d)
+	go s.i_ReplGet(w,d,msg)
+	return false
+}
+
@@ -0,0 +1,72 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewest(t *testing.T) {
+	rs := []replica{
+		{ok:true,resp:RESP_OK,value:[]byte("a"),version:2},
+		{ok:true,resp:RESP_Deleted,version:2},
+		{ok:true,resp:RESP_NotFound},
+		{ok:false},
+	}
+	if win,div := newest(rs); win!=1 || !div { t.Fatalf("a tombstone of the same version: %d %v",win,div) }
+	rs[0].version = 3
+	if win,_ := newest(rs); win!=0 { t.Fatalf("the newer value lost: %d",win) }
+	rs = rs[:1]
+	if win,div := newest(append(rs,rs[0])); win!=0 || div { t.Fatalf("equal replicas: %d %v",win,div) }
+	if win,_ := newest([]replica{{ok:true,resp:RESP_NotFound}}); win!=-1 { t.Fatal("a missing key has a winner") }
+}
+
+func TestQuorumRead(t *testing.T) {
+	c,ss := stores(t,3,3)
+	for _,s := range ss {
+		s.Repl.RepairRate = -1
+		s.Repl.Timeout = time.Millisecond*300
+	}
+	w := c.Nodes[0]
+	k := []byte("key")
+	hashnum := staticRing(nil).KeyHashnum(k)
+	for i,v := range []string{"a","b","c"} {
+		expect(t,call(t,w,c.Nodes[i].Name,MH_Put,hashnum,META_Versioned,0,k,versioned(uint64(10*(i+1)),[]byte(v))),"[0]")
+	}
+	
+	expect(t,call(t,w,"node-0",MH_ReplGet,k,CL_All),"[0 c 30 3 true]")
+	if r := fields(call(t,w,"node-0",MH_ReplGet,k,CL_One)); r[0]!="0" || r[3]!="1" { t.Fatalf("CL_One: %v",r) }
+	if r := fields(call(t,w,"node-0",MH_ReplGet,k,CL_Quorum)); r[0]!="0" || r[3]!="2" { t.Fatalf("CL_Quorum: %v",r) }
+	expect(t,call(t,w,"node-0",MH_ReplGet,[]byte("missing"),CL_All),"[1 3 false]")
+	
+	// The newest entry is a tombstone.
+	expect(t,call(t,w,"node-1",MH_Put,hashnum,META_Tombstone,0,k,versioned(40,nil)),"[0]")
+	expect(t,call(t,w,"node-0",MH_ReplGet,k,CL_All),"[1 3 true]")
+	
+	// node-2 can't be reached.
+	c.Net.Partition([]string{"node-0","node-1"},[]string{"node-2"})
+	expect(t,call(t,w,"node-0",MH_ReplGet,k,CL_All),"[10 2]")
+	expect(t,call(t,w,"node-0",MH_ReplGet,k,CL_Quorum),"[1 2 true]")
+}
@@ -0,0 +1,94 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package db
+
+import (
+	"github.com/byte-mug/cherdy/mlst"
+	"github.com/hashicorp/memberlist"
+	
+	"time"
+)
+
+/*
+After a replicated read, that saw divergent replicas, the coordinator pushes the
+newest value or tombstone, with it's expiresAt, to the replicas, that replied with an
+older version or without the key. The replicas drop the push, if they have a newer
+entry meanwhile. Replicas, that didn't reply, are left to anti-entropy.
+*/
+const (
+	DefaultRepairRate = 100 // Per second.
+	DefaultRepairBurst = 200
+)
+
+func (r *Replication) repairRate() (float64,int) {
+	rate,burst := r.RepairRate,r.RepairBurst
+	if rate==0 { rate = DefaultRepairRate }
+	if burst<=0 { burst = DefaultRepairBurst }
+	return rate,burst
+}
+
+func repairCounter(w *mlst.WrapNode, result string) *mlst.Counter {
+	return w.Metrics.Counter("cherdy_db_read_repairs_total","Read repairs by result.","result",result)
+}
+
+/*
+Pushes the winning value or tombstone to the lagging replicas in the background.
+*/
+func (s *Store) readRepair(w *mlst.WrapNode, hashnum int, key []byte, rs []replica, win int) {
+	rate,burst := s.Repl.repairRate()
+	if rate<0 { return } // Disabled.
+	
+	wr := &rs[win]
+	if wr.version==0 { return } // Unversioned entries have no order.
+	
+	var lag []*memberlist.Node
+	for _,r := range rs {
+		if !r.ok || (r.resp==wr.resp && r.version>=wr.version) { continue }
+		if !s.Repl.rlim.Take(rate,float64(burst),time.Now()) {
+			repairCounter(w,"dropped").Inc()
+			continue
+		}
+		lag = append(lag,r.node)
+	}
+	if len(lag)==0 { return }
+	
+	meta := byte(META_Versioned)
+	if wr.resp==RESP_Deleted { meta = META_Tombstone }
+	data := versioned(wr.version,wr.value)
+	expiresAt := wr.expiresAt
+	go func() {
+		// The replies to the repair are discarded by the CallTable.
+		mb := w.NewMessage()
+		mb.EncodeMulti(MH_Put,hashnum,meta,expiresAt,key,data,w.Name,uint64(0))
+		for i,err := range w.SendMany(mlst.ST_BestFit,lag,mb.Bytes()) {
+			if err!=nil {
+				w.Log.Debug("read repair failed","key",key,"to",lag[i].Name,"err",err)
+				repairCounter(w,"failed").Inc()
+			} else {
+				w.Log.Debug("read repair sent","key",key,"to",lag[i].Name)
+				repairCounter(w,"sent").Inc()
+			}
+		}
+	}()
+}
@@ -0,0 +1,95 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package db
+
+import (
+	"github.com/byte-mug/cherdy/simnet"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+Waits, until all replicas report want or the timeout elapses.
+*/
+func converge(t *testing.T, c *simnet.Cluster, key []byte, owners int, want string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second*3)
+	for {
+		rs := replicas(t,c,0,key)[:owners]
+		ok := true
+		for _,r := range rs { ok = ok && strings.HasPrefix(r,want) }
+		if ok { return }
+		if time.Now().After(deadline) { t.Fatalf("replicas %v, want %s",rs,want) }
+		time.Sleep(time.Millisecond*20)
+	}
+}
+
+func TestReadRepair(t *testing.T) {
+	c,_ := stores(t,3,3)
+	w := c.Nodes[0]
+	k := []byte("key")
+	hashnum := staticRing(nil).KeyHashnum(k)
+	expect(t,call(t,w,"node-0",MH_Put,hashnum,META_Versioned,0,k,versioned(10,[]byte("a"))),"[0]")
+	expect(t,call(t,w,"node-1",MH_Put,hashnum,META_Versioned,0,k,versioned(20,[]byte("b"))),"[0]")
+	
+	expect(t,call(t,w,"node-0",MH_ReplGet,k,CL_All),"[0 b 20 3 true]")
+	converge(t,c,k,3,"[0 b 20 ")
+	expect(t,call(t,w,"node-0",MH_ReplGet,k,CL_All),"[0 b 20 3 false]")
+	
+	// Tombstones are repaired the same way.
+	expect(t,call(t,w,"node-2",MH_Put,hashnum,META_Tombstone,0,k,versioned(30,nil)),"[0]")
+	expect(t,call(t,w,"node-0",MH_ReplGet,k,CL_All),"[1 3 true]")
+	converge(t,c,k,3,"[5 30 ")
+}
+
+func TestReadRepairSkips(t *testing.T) {
+	c,ss := stores(t,3,3)
+	w := c.Nodes[0]
+	
+	// Unversioned entries have no order.
+	k := []byte("raw")
+	hashnum := staticRing(nil).KeyHashnum(k)
+	expect(t,call(t,w,"node-0",MH_Put,hashnum,META_Raw,0,k,[]byte("a")),"[0]")
+	expect(t,call(t,w,"node-0",MH_ReplGet,k,CL_All),"[0 a 0 3 true]")
+	time.Sleep(time.Millisecond*100)
+	expect(t,call(t,w,"node-1",MH_Get,hashnum,k),"[1]")
+	
+	// Only one repair is allowed.
+	ss[0].Repl.RepairRate,ss[0].Repl.RepairBurst = 0.001,1
+	k = []byte("limited")
+	hashnum = staticRing(nil).KeyHashnum(k)
+	expect(t,call(t,w,"node-0",MH_Put,hashnum,META_Versioned,0,k,versioned(10,[]byte("a"))),"[0]")
+	expect(t,call(t,w,"node-0",MH_ReplGet,k,CL_All),"[0 a 10 3 true]")
+	time.Sleep(time.Millisecond*100)
+	missing := 0
+	for _,r := range replicas(t,c,0,k)[:3] {
+		if r=="[1]" { missing++ }
+	}
+	if missing!=1 { t.Fatalf("%d replicas without the key, want 1",missing) }
+	
+	var sb strings.Builder
+	w.Metrics.WritePrometheus(&sb)
+	if !strings.Contains(sb.String(),`cherdy_db_read_repairs_total{result="dropped"} 1`+"\n") { t.Error("the dropped repair is not counted") }
+}
@@ -0,0 +1,368 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package db
+
+import (
+	"github.com/dgraph-io/badger"
+	"github.com/byte-mug/cherdy/mlst"
+	"github.com/byte-mug/golibs/bufferex"
+	"github.com/hashicorp/memberlist"
+	
+	"context"
+	"sync"
+	"time"
+)
+
+/*
+A replicated write is sent to any node, which acts as coordinator:
+
+	MH_ReplPut, expiresAt, key, value, quorum, target, targid
+	MH_PutResponse, targid, resp, version, acks
+
+The coordinator stamps the value with a new version and sends it as META_Versioned
+MH_Put to all owners of the key, using the hashnum from Ring.KeyHashnum. It responds
+RESP_OK, once quorum owners (0 means Replication.W) have acknowledged the write, or
+RESP_QuorumFailed otherwise.
+
+A replicated delete works the same way:
+
+	MH_ReplDelete, key, quorum, target, targid
+	MH_DeleteResponse, targid, resp, version, acks
+
+The coordinator sends a tombstone with a new version as META_Tombstone MH_Put, whose
+value is versioned(version,nil).
+
+Replicas keep the entry with the highest version (last write wins). A tombstone
+counts as an entry, so older writes don't bring a deleted key back. Superseded
+writes are acknowledged, but dropped.
+*/
+
+const DefaultReplTimeout = time.Second*2
+
+/*
+Maps keys onto the nodes, that own them. It is implemented by xhashring.Subscriber.
+*/
+type Ring interface{
+	// Returns the names of the owners of the key, including dead ones.
+	KeyOwners(key []byte) []string
+	
+	// Returns the ownership range of the key and it's owners.
+	KeyRange(key []byte) (id string, owners []string)
+	
+	// Returns the hashnum of the key. Replicated operations, anti-entropy and hints
+	// use it, so every owner stores the key in the same home shard.
+	KeyHashnum(key []byte) int
+}
+
+type Replication struct{
+	Ring Ring // If nil, replicated operations are rejected.
+	
+	// The write quorum. Default: a majority of the owners.
+	W int
+	
+	// How long the coordinator waits for acknowledgements. Default: DefaultReplTimeout
+	Timeout time.Duration
+	
+	// Read repairs per second and burst size. Default: DefaultRepairRate and
+	// DefaultRepairBurst. A negative rate disables read repair.
+	RepairRate  float64
+	RepairBurst int
+	
+	// How long anti-entropy reuses it's hash trees. Default: DefaultTreeAge
+	TreeAge time.Duration
+	
+	// How long hints for unreachable owners are kept. Default: DefaultHintTTL
+	HintTTL time.Duration
+	
+	rlim mlst.TokenBucket // Read repairs.
+}
+
+func (r *Replication) quorum(q, n int) int {
+	if q<=0 { q = r.W }
+	if q<=0 { q = n/2+1 }
+	return q
+}
+
+/*
+Returns the replication timeout, shortened to the deadline of the request.
+*/
+func (r *Replication) timeout(ctx context.Context) time.Duration {
+	t := r.Timeout
+	if t<=0 { t = DefaultReplTimeout }
+	if dl,ok := ctx.Deadline(); ok {
+		if u := time.Until(dl); u<t { t = u }
+	}
+	return t
+}
+
+/*
+Resolves the names of the owners. Dead nodes are returned as nil.
+*/
+func owners(w *mlst.WrapNode, names []string) []*memberlist.Node {
+	nodes := make([]*memberlist.Node,len(names))
+	for i,n := range names { nodes[i] = w.Lookup(n) }
+	return nodes
+}
+
+/*
+Sends a request to each node and collects the replies, until accept has returned
+true for k replies, all nodes have replied or timeout elapses. Returns the number of
+accepted replies.
+
+build is called once per node with the call-id. accept is called with the index of
+the node and it's reply and must not retain the reply. If fail is not nil, it is
+called with the index of every node, that is nil or could not be sent to, even if
+gather has already returned.
+*/
+func gather(w *mlst.WrapNode, nodes []*memberlist.Node, k int, timeout time.Duration, build func(id uint64) []byte, accept func(i int, r *mlst.Reply) bool, fail func(i int)) (n int) {
+	type reply struct{
+		i int
+		r *mlst.Reply // nil, if the send failed.
+	}
+	ch := make(chan reply,len(nodes))
+	done := make(chan struct{})
+	var lck sync.Mutex
+	closed := false
+	
+	// Hands the reply over to gather or frees it, if gather has returned.
+	deliver := func(r reply) {
+		lck.Lock()
+		defer lck.Unlock()
+		if !closed {
+			ch <- r
+		} else if r.r!=nil {
+			r.r.Free()
+		}
+	}
+	
+	pending := 0
+	for i,node := range nodes {
+		if node==nil {
+			if fail!=nil { fail(i) }
+			continue
+		}
+		pending++
+		go func(i int,node *memberlist.Node) {
+			c := w.Calls.New(1)
+			defer c.Close()
+			if w.SendTo(mlst.ST_BestFit,node,build(c.ID))!=nil {
+				if fail!=nil { fail(i) }
+				deliver(reply{i,nil})
+				return
+			}
+			select {
+			case r := <-c.C: deliver(reply{i,r})
+			case <-done:
+			}
+		}(i,node)
+	}
+	defer func() {
+		lck.Lock()
+		closed = true
+		lck.Unlock()
+		close(done)
+		for {
+			select {
+			case r := <-ch:
+				if r.r!=nil { r.r.Free() }
+			default: return
+			}
+		}
+	}()
+	
+	tm := time.NewTimer(timeout)
+	defer tm.Stop()
+	for n<k && pending>0 {
+		select {
+		case r := <-ch:
+			pending--
+			if r.r==nil { continue }
+			if accept(r.i,r.r) { n++ }
+			r.r.Free()
+		case <-tm.C: return
+		}
+	}
+	return
+}
+
+/*
+Sends ent as MH_Put to all owners of it's key and waits for the write quorum. Owners,
+that can't be reached, get a hint. Returns the number of acknowledgements, the quorum
+and the number of owners.
+*/
+func (s *Store) replicate(w *mlst.WrapNode, d *mlst.MessageReader, sp *mlst.Span, quorum int, ent *badger.Entry) (acks, k, n int) {
+	hashnum := s.Repl.Ring.KeyHashnum(ent.Key)
+	names := s.Repl.Ring.KeyOwners(ent.Key)
+	nodes := owners(w,names)
+	k = s.Repl.quorum(quorum,len(nodes))
+	acks = gather(w,nodes,k,s.Repl.timeout(d.Context()),func(id uint64) []byte {
+		mb := w.NewMessage()
+		mb.EncodeSpan(sp)
+		mb.EncodeMulti(MH_Put,hashnum,ent.UserMeta,ent.ExpiresAt,ent.Key,ent.Value,w.Name,id)
+		return mb.Bytes()
+	},func(i int, r *mlst.Reply) bool {
+		resp,err := r.DecodeInt()
+		return err==nil && resp==RESP_OK
+	},func(i int) {
+		// Keep the write for the owner, that could not be reached.
+		s.hint(w,names[i],hashnum,ent)
+	})
+	return acks,k,len(nodes)
+}
+
+func (s *Store) i_ReplPut(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) {
+	defer d.Release(msg)
+	expiresAt,err := d.DecodeUint64()
+	if err!=nil { w.Log.Debug("malformed MH_ReplPut","err",err); return }
+	
+	key,err := d.DecodeBytes()
+	if err!=nil { w.Log.Debug("malformed MH_ReplPut","err",err); return }
+	
+	value,err := d.DecodeBytes()
+	if err!=nil { w.Log.Debug("malformed MH_ReplPut","err",err); return }
+	
+	quorum,err := d.DecodeInt()
+	if err!=nil { w.Log.Debug("malformed MH_ReplPut","err",err); return }
+	
+	target,err := d.DecodeString()
+	if err!=nil { w.Log.Debug("malformed MH_ReplPut","err",err); return }
+	
+	targid,err := d.DecodeUint64()
+	if err!=nil { w.Log.Debug("malformed MH_ReplPut","err",err); return }
+	
+	if s.Repl.Ring==nil {
+		w.Log.Debug("replicated put rejected","reason","no-ring","key",key)
+		s.i_Respond(w,MH_PutResponse,target,targid,RESP_Illegal)
+		return
+	}
+	
+	sp := w.Tracer.Start(d,"db repl-put")
+	defer sp.Finish()
+	
+	version := nextVersion(0)
+	ent := &badger.Entry{Key:key,Value:versioned(version,value),UserMeta:META_Versioned,ExpiresAt:expiresAt}
+	acks,k,n := s.replicate(w,d,sp,quorum,ent)
+	if sp!=nil { sp.SetAttr("acks",acks) }
+	
+	if acks<k {
+		w.Log.Warn("replicated put failed","key",key,"acks",acks,"quorum",k,"owners",n)
+		w.Metrics.Counter("cherdy_db_repl_writes_total","Replicated writes by result.","result","quorum-failed").Inc()
+		s.i_Respond(w,MH_PutResponse,target,targid,RESP_QuorumFailed,version,acks)
+		return
+	}
+	w.Metrics.Counter("cherdy_db_repl_writes_total","Replicated writes by result.","result","ok").Inc()
+	s.i_Respond(w,MH_PutResponse,target,targid,RESP_OK,version,acks)
+}
+func (s *Store) ReplPut(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) bool {
+	mlst.RetainBinary(d)
+	go s.i_ReplPut(w,d,msg)
+	return false
+}
+
+func (s *Store) i_ReplDelete(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) {
+	defer d.Release(msg)
+	key,err := d.DecodeBytes()
+	if err!=nil { w.Log.Debug("malformed MH_ReplDelete","err",err); return }
+	
+	quorum,err := d.DecodeInt()
+	if err!=nil { w.Log.Debug("malformed MH_ReplDelete","err",err); return }
+	
+	target,err := d.DecodeString()
+	if err!=nil { w.Log.Debug("malformed MH_ReplDelete","err",err); return }
+	
+	targid,err := d.DecodeUint64()
+	if err!=nil { w.Log.Debug("malformed MH_ReplDelete","err",err); return }
+	
+	if s.Repl.Ring==nil {
+		w.Log.Debug("replicated delete rejected","reason","no-ring","key",key)
+		s.i_Respond(w,MH_DeleteResponse,target,targid,RESP_Illegal)
+		return
+	}
+	
+	sp := w.Tracer.Start(d,"db repl-delete")
+	defer sp.Finish()
+	
+	version := nextVersion(0)
+	expiresAt := uint64(time.Now().Add(s.tombstoneTTL()).Unix())
+	ent := &badger.Entry{Key:key,Value:versioned(version,nil),UserMeta:META_Tombstone,ExpiresAt:expiresAt}
+	acks,k,n := s.replicate(w,d,sp,quorum,ent)
+	if sp!=nil { sp.SetAttr("acks",acks) }
+	
+	if acks<k {
+		w.Log.Warn("replicated delete failed","key",key,"acks",acks,"quorum",k,"owners",n)
+		w.Metrics.Counter("cherdy_db_repl_deletes_total","Replicated deletes by result.","result","quorum-failed").Inc()
+		s.i_Respond(w,MH_DeleteResponse,target,targid,RESP_QuorumFailed,version,acks)
+		return
+	}
+	w.Metrics.Counter("cherdy_db_repl_deletes_total","Replicated deletes by result.","result","ok").Inc()
+	s.i_Respond(w,MH_DeleteResponse,target,targid,RESP_OK,version,acks)
+}
+func (s *Store) ReplDelete(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) bool {
+	mlst.RetainBinary(d)
+	go s.i_ReplDelete(w,d,msg)
+	return false
+}
+
+/*
+Stores a META_Versioned entry or a META_Tombstone, unless the key already has a newer
+version or tombstone. On equal versions, the entry already stored wins.
+*/
+func (s *Store) putVersioned(hashnum int, ent *badger.Entry) (stored bool,err error) {
+	version,_,err := unversion(ent.Value)
+	if err!=nil { return false,ErrIllegal }
+	
+	m := s.klck.lock(ent.Key)
+	defer m.Unlock()
+	
+	cur,err := s.current(hashnum,ent.Key)
+	if err!=nil { return }
+	if (cur.db!=nil || cur.deleted) && cur.version>=version { return false,nil }
+	
+	if ent.UserMeta==META_Tombstone {
+		ls,err := s.locate(hashnum,ent.Key)
+		if err!=nil { return false,err }
+		expiresAt := ent.ExpiresAt
+		if expiresAt==0 { expiresAt = uint64(time.Now().Add(s.tombstoneTTL()).Unix()) }
+		_,_,err = s.tombstone(hashnum,ent.Key,ls,version,expiresAt)
+		return err==nil,err
+	}
+	return true,s.replace(hashnum,cur,ent)
+}
+
+func (s *Store) i_PutVersioned(w *mlst.WrapNode, hashnum int, ent *badger.Entry, target string,targid uint64) {
+	stored,err := s.putVersioned(hashnum,ent)
+	switch {
+	case err==ErrIllegal:
+		w.Log.Debug("put rejected","reason","bad-version","key",ent.Key)
+		s.i_PutResponse(w,target,targid,RESP_Illegal)
+	case err!=nil:
+		w.Log.Error("put failed","key",ent.Key,"err",err)
+		if err!=ErrNoSpace { ioError(w,"put") }
+		s.i_PutResponse(w,target,targid,RESP_IoError,unwrapCause(err).Error())
+	default:
+		if !stored { w.Log.Debug("put superseded","key",ent.Key) }
+		s.i_PutResponse(w,target,targid,RESP_OK)
+	}
+}
+
@@ -0,0 +1,87 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package db
+
+import (
+	"github.com/byte-mug/cherdy/simnet"
+	"strconv"
+	"testing"
+	"time"
+)
+
+/*
+Returns the reply of MH_GetVersioned from every node.
+*/
+func replicas(t *testing.T, c *simnet.Cluster, from int, key []byte) (rs []string) {
+	hashnum := staticRing(nil).KeyHashnum(key)
+	for _,nd := range c.Nodes {
+		rs = append(rs,call(t,c.Nodes[from],nd.Name,MH_GetVersioned,hashnum,key))
+	}
+	return
+}
+
+func TestReplicatedWrite(t *testing.T) {
+	c,_ := stores(t,4,3)
+	w := c.Nodes[3]
+	k := []byte("key")
+	
+	r := fields(call(t,w,"node-0",MH_ReplPut,0,k,[]byte("v1"),3))
+	if r[0]!="0" || r[2]!="3" { t.Fatalf("replicated put: %v",r) }
+	v1,_ := strconv.ParseUint(r[1],10,64)
+	rs := replicas(t,c,3,k)
+	for _,got := range rs[:3] { expect(t,got,"[0 v1 "+r[1]+" 0]") }
+	expect(t,rs[3],"[1]") // Not an owner.
+	
+	// An older write is acknowledged, but dropped.
+	hashnum := staticRing(nil).KeyHashnum(k)
+	expect(t,call(t,w,"node-1",MH_Put,hashnum,META_Versioned,0,k,versioned(v1-1,[]byte("old"))),"[0]")
+	expect(t,call(t,w,"node-1",MH_Get,hashnum,k),"[0 v1]")
+	
+	// A replicated delete reaches all owners and keeps older writes out.
+	r = fields(call(t,w,"node-2",MH_ReplDelete,k,0))
+	if r[0]!="0" { t.Fatalf("replicated delete: %v",r) }
+	for _,got := range replicas(t,c,3,k)[:3] {
+		if f := fields(got); f[0]!="5" || f[1]!=r[1] { t.Fatalf("replica after delete: %v",got) }
+	}
+	expect(t,call(t,w,"node-1",MH_Put,hashnum,META_Versioned,0,k,versioned(v1,[]byte("v1"))),"[0]")
+	expect(t,call(t,w,"node-1",MH_Get,hashnum,k),"[1]")
+	
+	// A newer write brings it back.
+	r = fields(call(t,w,"node-0",MH_ReplPut,0,k,[]byte("v2"),0))
+	if r[0]!="0" { t.Fatalf("replicated put after delete: %v",r) }
+	time.Sleep(time.Millisecond*50) // The quorum does not wait for the last owner.
+	for _,got := range replicas(t,c,3,k)[:3] { expect(t,got,"[0 v2 "+r[1]+" 0]") }
+}
+
+func TestReplicatedQuorum(t *testing.T) {
+	c,_ := stores(t,3,3)
+	w := c.Nodes[0]
+	// There are only three owners.
+	r := fields(call(t,w,"node-0",MH_ReplPut,0,[]byte("k"),[]byte("v"),4))
+	if r[0]!="10" || r[2]!="3" { t.Fatalf("quorum 4 of 3: %v",r) }
+	
+	c,_ = stores(t,2,0)
+	expect(t,call(t,c.Nodes[0],"node-0",MH_ReplPut,0,[]byte("k"),[]byte("v"),0),"[4]")
+	expect(t,call(t,c.Nodes[0],"node-0",MH_ReplDelete,[]byte("k"),0),"[4]")
+}
@@ -0,0 +1,316 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package db
+
+import (
+	"github.com/dgraph-io/badger"
+	"github.com/byte-mug/cherdy/mlst"
+	"github.com/byte-mug/golibs/bufferex"
+	"github.com/hashicorp/memberlist"
+	
+	"bytes"
+	"context"
+	gerrors "errors"
+	"sort"
+	"time"
+)
+
+/*
+Scans iterate over the keys of all local shards and the Redirects DB in key order:
+
+	MH_Scan, prefix, start, end, limit, token, target, targid
+	MH_ScanResponse, targid, resp, count, (key, resp, payload)*count, token
+
+start is inclusive, end is exclusive; both may be empty. The per-key resp is either
+RESP_OK with the value as payload or RESP_Redirect with the node name. If the
+response token is not nil, there are more keys; the next scan resumes after it.
+*/
+const (
+	MaxScanLimit = 1000
+	
+	// Stop filling a scan response, once the keys and values exceed this size.
+	MaxScanBytes = 1<<18
+)
+
+var (
+	ErrPartial = gerrors.New("Not all nodes responded")
+)
+
+/*
+Merges the iterators of all databases. If a key is present in more than one
+database, the first one wins.
+*/
+type scanMerge struct{
+	txs    []*badger.Txn
+	its    []*badger.Iterator
+	shard  []int // The shard index of each iterator, shardRedirects for the Redirects DB.
+	cur    int
+	prefix []byte
+	end    []byte
+	tombs  bool // Return tombstones, too.
+}
+
+func (s *Store) newScan(prefix, from, end []byte) *scanMerge {
+	m := &scanMerge{prefix:prefix,end:end}
+	dbs := append(append([]*badger.DB{},s.Data...),s.Redirects)
+	for i,db := range dbs {
+		if db==nil { continue }
+		if i==len(s.Data) { i = shardRedirects }
+		tx := db.NewTransaction(false)
+		opt := badger.DefaultIteratorOptions
+		opt.PrefetchValues = false
+		opt.Prefix = prefix
+		it := tx.NewIterator(opt)
+		it.Seek(from)
+		m.txs = append(m.txs,tx)
+		m.its = append(m.its,it)
+		m.shard = append(m.shard,i)
+	}
+	return m
+}
+func (m *scanMerge) Close() {
+	for _,it := range m.its { it.Close() }
+	for _,tx := range m.txs { tx.Discard() }
+}
+func (m *scanMerge) valid(it *badger.Iterator) bool {
+	if !it.ValidForPrefix(m.prefix) { return false }
+	if len(m.end)!=0 && bytes.Compare(it.Item().Key(),m.end)>=0 { return false }
+	return true
+}
+
+/*
+Returns the next item, that is neither a hint nor a tombstone (unless tombs is set),
+or nil. The item is valid until Advance is called.
+*/
+func (m *scanMerge) Next() *badger.Item {
+	for {
+		m.cur = -1
+		var min *badger.Iterator
+		for i,it := range m.its {
+			// Skip hints, the data lives in another shard.
+			for m.valid(it) && it.Item().UserMeta()==META_InnerRedirect { it.Next() }
+			if !m.valid(it) { continue }
+			if min==nil || bytes.Compare(it.Item().Key(),min.Item().Key())<0 { min,m.cur = it,i }
+		}
+		if min==nil { return nil }
+		item := min.Item()
+		
+		// Drop the same key from the other databases.
+		for _,it := range m.its {
+			if it!=min && m.valid(it) && bytes.Equal(it.Item().Key(),item.Key()) { it.Next() }
+		}
+		if item.UserMeta()==META_Tombstone && !m.tombs {
+			min.Next()
+			continue
+		}
+		return item
+	}
+}
+func (m *scanMerge) Advance() {
+	if m.cur>=0 { m.its[m.cur].Next() }
+}
+
+/*
+The shard index, reported for items of the Redirects DB.
+*/
+const shardRedirects = -1
+
+/*
+Returns the shard index of the current item or shardRedirects.
+*/
+func (m *scanMerge) Shard() int { return m.shard[m.cur] }
+
+func (s *Store) i_Scan(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) {
+	defer d.Release(msg)
+	prefix,err := d.DecodeBytes()
+	if err!=nil { w.Log.Debug("malformed MH_Scan","err",err); return }
+	
+	start,err := d.DecodeBytes()
+	if err!=nil { w.Log.Debug("malformed MH_Scan","err",err); return }
+	
+	end,err := d.DecodeBytes()
+	if err!=nil { w.Log.Debug("malformed MH_Scan","err",err); return }
+	
+	limit,err := d.DecodeInt()
+	if err!=nil { w.Log.Debug("malformed MH_Scan","err",err); return }
+	
+	token,err := d.DecodeBytes()
+	if err!=nil { w.Log.Debug("malformed MH_Scan","err",err); return }
+	
+	target,err := d.DecodeString()
+	if err!=nil { w.Log.Debug("malformed MH_Scan","err",err); return }
+	
+	targid,err := d.DecodeUint64()
+	if err!=nil { w.Log.Debug("malformed MH_Scan","err",err); return }
+	
+	node := w.Lookup(target)
+	if node==nil {
+		w.Log.Debug("scan response dropped","reason","unknown-requester","target",target)
+		return
+	}
+	
+	// If the sender has already given up, don't waste I/O.
+	if d.Context().Err()!=nil {
+		w.Log.Debug("scan discarded","reason","deadline")
+		return
+	}
+	
+	sp := w.Tracer.Start(d,"db scan")
+	defer sp.Finish()
+	
+	if limit<=0 || limit>MaxScanLimit { limit = MaxScanLimit }
+	
+	from := start
+	if bytes.Compare(from,prefix)<0 { from = prefix }
+	// The smallest key after token. token points into the message, so copy it.
+	if token!=nil && bytes.Compare(token,from)>=0 { from = append(append(make([]byte,0,len(token)+1),token...),0) }
+	
+	m := s.newScan(prefix,from,end)
+	defer m.Close()
+	
+	mb := w.NewMessage()
+	body := new(mlst.MessageBuffer).Init()
+	n,size := 0,0
+	var last []byte
+	var ierr error
+	for {
+		item := m.Next()
+		if item==nil { last = nil; break }
+		if n>=limit || size>=MaxScanBytes { break }
+		last = item.KeyCopy(nil)
+		var val []byte
+		val,_,ierr = itemValue(item)
+		if ierr!=nil { break }
+		switch item.UserMeta() {
+		case META_OuterRedirect: body.EncodeMulti(last,RESP_Redirect,string(val))
+		default: body.EncodeMulti(last,RESP_OK,val)
+		}
+		n++
+		size += len(last)+len(val)
+		m.Advance()
+	}
+	if ierr!=nil {
+		w.Log.Error("scan failed","err",ierr)
+		ioError(w,"scan")
+		mb.EncodeMulti(MH_ScanResponse,targid,RESP_IoError,unwrapCause(ierr).Error())
+	} else {
+		if sp!=nil { sp.SetAttr("count",n) }
+		mb.EncodeMulti(MH_ScanResponse,targid,RESP_OK,n)
+		mb.Write(body.Bytes())
+		mb.EncodeBytes(last)
+	}
+	w.SendTo(mlst.ST_BestFit,node,mb.Bytes())
+}
+func (s *Store) Scan(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) bool {
+	mlst.RetainBinary(d)
+	go s.i_Scan(w,d,msg)
+	return false
+}
+
+/*
+A scan across multiple nodes.
+*/
+type ScanQuery struct{
+	Prefix, Start, End []byte
+	Limit int
+	
+	// The continuation token of the previous scan or nil.
+	Token []byte
+}
+
+type ScanEntry struct{
+	Key, Value []byte
+	
+	// If not empty, the key has been redirected to this node, that didn't respond with it.
+	Redirect string
+}
+
+/*
+Scans the given nodes (usually all ring owners) concurrently and merges the results
+in key order. Keys, that are returned by more than one node, are reported once.
+
+If next is not nil, there are more keys; pass it as q.Token to continue. If not all
+nodes responded in time, ErrPartial is returned along with the entries.
+*/
+func ScanNodes(w *mlst.WrapNode, nodes []*memberlist.Node, q ScanQuery, timeout time.Duration) (es []ScanEntry, next []byte, err error) {
+	limit := q.Limit
+	if limit<=0 || limit>MaxScanLimit { limit = MaxScanLimit }
+	ctx,cancel := context.WithTimeout(context.Background(),timeout)
+	defer cancel()
+	rs,_ := w.RequestMany(mlst.ST_BestFit,nodes,len(nodes),timeout,func(id uint64) []byte {
+		mb := w.NewMessage()
+		mb.EncodeContext(ctx)
+		mb.EncodeMulti(MH_Scan,q.Prefix,q.Start,q.End,limit,q.Token,w.Name,id)
+		return mb.Bytes()
+	})
+	if len(rs)<len(nodes) { err = ErrPartial }
+	
+	var all []ScanEntry
+	var cutoff []byte // The smallest last key of all truncated responses.
+	for _,r := range rs {
+		trunc,rerr := decodeScan(r,&all)
+		r.Free()
+		if rerr!=nil { err = rerr; continue }
+		if trunc!=nil && (cutoff==nil || bytes.Compare(trunc,cutoff)<0) { cutoff = trunc }
+	}
+	
+	sort.SliceStable(all,func(i,j int) bool { return bytes.Compare(all[i].Key,all[j].Key)<0 })
+	for _,e := range all {
+		if cutoff!=nil && bytes.Compare(e.Key,cutoff)>0 { break }
+		if l := len(es); l>0 && bytes.Equal(es[l-1].Key,e.Key) {
+			if es[l-1].Redirect!="" && e.Redirect=="" { es[l-1] = e }
+			continue
+		}
+		if len(es)==limit { break }
+		es = append(es,e)
+	}
+	if len(es)==limit || (cutoff!=nil && len(es)!=0) { next = es[len(es)-1].Key }
+	return
+}
+
+func decodeScan(r *mlst.Reply, es *[]ScanEntry) (token []byte,err error) {
+	resp,err := r.DecodeInt()
+	if err!=nil { return }
+	if resp!=RESP_OK {
+		msg,_ := r.DecodeString()
+		return nil,gerrors.New(msg)
+	}
+	n,err := decodeCount(r.MessageReader)
+	if err!=nil { return }
+	for i := 0; i<n; i++ {
+		var e ScanEntry
+		var eresp int
+		if e.Key,err = r.DecodeBytes(); err!=nil { return }
+		if eresp,err = r.DecodeInt(); err!=nil { return }
+		switch eresp {
+		case RESP_Redirect: e.Redirect,err = r.DecodeString()
+		default: e.Value,err = r.DecodeBytes()
+		}
+		if err!=nil { return }
+		*es = append(*es,e)
+	}
+	token,err = r.DecodeBytes()
+	return
+}
+
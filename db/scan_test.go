@@ -0,0 +1,81 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package db
+
+import (
+	"github.com/hashicorp/memberlist"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScanNodes(t *testing.T) {
+	c,_ := stores(t,3,0)
+	w := c.Nodes[2]
+	put := func(node string, hashnum int, k string) {
+		expect(t,call(t,w,node,MH_Put,hashnum,META_Raw,0,[]byte(k),[]byte(strings.ToUpper(k))),"[0]")
+	}
+	put("node-0",0,"a1")
+	put("node-0",1,"a3")
+	put("node-0",1,"b1")
+	put("node-1",0,"a2")
+	put("node-1",1,"a3") // On both nodes.
+	put("node-1",0,"a4")
+	expect(t,call(t,w,"node-1",MH_Delete,0,[]byte("a4")),"[0]")
+	
+	nodes := []*memberlist.Node{w.Lookup("node-0"),w.Lookup("node-1")}
+	scan := func(q ScanQuery) (keys string, next []byte) {
+		es,next,err := ScanNodes(w,nodes,q,time.Second)
+		if err!=nil { t.Fatal(err) }
+		var ks []string
+		for _,e := range es {
+			if strings.ToUpper(string(e.Key))!=string(e.Value) { t.Fatalf("%s = %s",e.Key,e.Value) }
+			ks = append(ks,string(e.Key))
+		}
+		return strings.Join(ks," "),next
+	}
+	
+	keys,next := scan(ScanQuery{Prefix:[]byte("a"),Limit:2})
+	expect(t,keys,"a1 a2")
+	if string(next)!="a2" { t.Fatalf("token %q",next) }
+	keys,next = scan(ScanQuery{Prefix:[]byte("a"),Limit:2,Token:next})
+	expect(t,keys,"a3")
+	if next!=nil { t.Fatalf("token %q after the last key",next) }
+	
+	keys,_ = scan(ScanQuery{Start:[]byte("a2"),End:[]byte("b1")})
+	expect(t,keys,"a2 a3")
+	keys,_ = scan(ScanQuery{})
+	expect(t,keys,"a1 a2 a3 b1")
+}
+
+func TestScanPartial(t *testing.T) {
+	c,_ := stores(t,3,0)
+	w := c.Nodes[2]
+	expect(t,call(t,w,"node-0",MH_Put,0,META_Raw,0,[]byte("k"),[]byte("v")),"[0]")
+	c.Net.Partition([]string{"node-0","node-2"},[]string{"node-1"})
+	nodes := []*memberlist.Node{w.Lookup("node-0"),w.Lookup("node-1")}
+	es,_,err := ScanNodes(w,nodes,ScanQuery{},time.Millisecond*200)
+	if err!=ErrPartial { t.Fatalf("err = %v",err) }
+	if len(es)!=1 || string(es[0].Key)!="k" { t.Fatalf("entries %v",es) }
+}
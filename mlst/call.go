@@ -0,0 +1,224 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst
+
+import (
+	"github.com/hashicorp/memberlist"
+	"github.com/vmihailenco/msgpack"
+	"github.com/byte-mug/golibs/bufferex"
+	"bytes"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrNoNode = errors.New("No such node")
+)
+
+/*
+A Reply, that has been received for a Call. The reader is positioned right after
+the call-id. The caller must Free() it.
+*/
+type Reply struct{
+	*MessageReader
+	Msg bufferex.Binary
+}
+func (r *Reply) Free() { r.Release(r.Msg) }
+
+/*
+A pending request, that awaits replies.
+*/
+type Call struct{
+	ID uint64
+	C  <-chan *Reply
+	
+	ch  chan *Reply
+	tab *CallTable
+}
+
+/*
+Unregisters the call and frees all replies, that have not been received yet.
+
+Replies are only queued while holding the table lock, so no reply can arrive
+after the call has been removed from the table.
+*/
+func (c *Call) Close() {
+	c.tab.lck.Lock()
+	delete(c.tab.calls,c.ID)
+	c.tab.lck.Unlock()
+	for {
+		select {
+		case r := <-c.ch: r.Free()
+		default: return
+		}
+	}
+}
+
+/*
+Waits for up to k replies. If timeout elapses before, the replies received so far
+are returned.
+*/
+func (c *Call) Wait(k int, timeout time.Duration) (rs []*Reply) {
+	if k<=0 { return }
+	tm := time.NewTimer(timeout)
+	defer tm.Stop()
+	for len(rs)<k {
+		select {
+		case r := <-c.ch: rs = append(rs,r)
+		case <-tm.C: return
+		}
+	}
+	return
+}
+
+/*
+The CallTable correlates replies with requests.
+
+A request contains the name of the requesting node and the call-id. The reply
+consists of a response header, which is bound to Deliver, followed by the call-id.
+
+	wn.Handlers[MH_MyResponse] = wn.Calls.Deliver
+*/
+type CallTable struct{
+	lck   sync.Mutex
+	seq   uint64
+	calls map[uint64]*Call
+}
+func (t *CallTable) Init() {
+	t.calls = make(map[uint64]*Call)
+	t.seq = uint64(time.Now().UnixNano())
+}
+
+/*
+Returns a new id, that is unique among the call-ids of this table.
+*/
+func (t *CallTable) next() uint64 { return atomic.AddUint64(&t.seq,1) }
+
+/*
+Creates a new call, that can buffer up to n replies.
+*/
+func (t *CallTable) New(n int) *Call {
+	if n<1 { n = 1 }
+	c := &Call{ID:t.next(),ch:make(chan *Reply,n),tab:t}
+	c.C = c.ch
+	t.lck.Lock()
+	defer t.lck.Unlock()
+	t.calls[c.ID] = c
+	return c
+}
+
+/*
+A Handler, that delivers the reply to the matching call. Replies to unknown or
+closed calls and excess replies are discarded and freed.
+*/
+func (t *CallTable) Deliver(w *WrapNode,d *MessageReader, msg bufferex.Binary) bool {
+	id,err := d.DecodeUint64()
+	if err!=nil { return false }
+	t.deliver(id,d,msg)
+	return false
+}
+
+/*
+Returns a Handler, that delivers replies to calls of this table and passes all
+other messages to prev. This allows multiple components to share one response
+header. If prev is nil, this is equivalent to Deliver.
+
+	wn.Handlers[MH_MyResponse] = wn.Calls.Chain(wn.Handlers[MH_MyResponse])
+*/
+func (t *CallTable) Chain(prev Handler) Handler {
+	if prev==nil { return t.Deliver }
+	return func(w *WrapNode,d *MessageReader, msg bufferex.Binary) bool {
+		id,err := msgpack.NewDecoder(bytes.NewReader(d.Bytes())).DecodeUint64()
+		if err!=nil || !t.known(id) { return prev(w,d,msg) }
+		return t.Deliver(w,d,msg)
+	}
+}
+func (t *CallTable) known(id uint64) bool {
+	t.lck.Lock()
+	defer t.lck.Unlock()
+	return t.calls[id]!=nil
+}
+
+/*
+Queues the reply, if the call is still open. Otherwise, the message is freed.
+The reply is queued under the table lock, so that it can not race with Close.
+*/
+func (t *CallTable) deliver(id uint64,d *MessageReader, msg bufferex.Binary) bool {
+	RetainBinary(d)
+	t.lck.Lock()
+	defer t.lck.Unlock()
+	if c := t.calls[id]; c!=nil {
+		select {
+		case c.ch <- &Reply{d,msg}: return true
+		default:
+		}
+	}
+	d.Release(msg)
+	return false
+}
+
+/*
+Sends msg to all nodes concurrently, using the same buffer. errs[i] is the result
+for nodes[i]. Returns, when all sends are done.
+*/
+func (w *WrapNode) SendMany(st SendType,nodes []*memberlist.Node, msg []byte) (errs []error) {
+	errs = make([]error,len(nodes))
+	var wg sync.WaitGroup
+	for i,node := range nodes {
+		if node==nil { errs[i] = ErrNoNode; continue }
+		wg.Add(1)
+		go func(i int,node *memberlist.Node) {
+			defer wg.Done()
+			errs[i] = w.SendTo(st,node,msg)
+		}(i,node)
+	}
+	wg.Wait()
+	return
+}
+
+/*
+Sends a request to all nodes and waits for the first k replies or until timeout.
+
+build is called once with the call-id and returns the request. The request must
+instruct the receivers to reply to w.Name with the given call-id.
+
+The caller must Free() the replies. If less than k sends succeeded, it only waits
+for as many replies as there have been successful sends.
+*/
+func (w *WrapNode) RequestMany(st SendType,nodes []*memberlist.Node, k int, timeout time.Duration, build func(id uint64) []byte) (rs []*Reply, errs []error) {
+	c := w.Calls.New(len(nodes))
+	defer c.Close()
+	
+	errs = w.SendMany(st,nodes,build(c.ID))
+	ok := 0
+	for _,err := range errs {
+		if err==nil { ok++ }
+	}
+	if k>ok { k = ok }
+	rs = c.Wait(k,timeout)
+	return
+}
+
@@ -0,0 +1,115 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst_test
+
+import (
+	"github.com/byte-mug/cherdy/mlst"
+	"github.com/hashicorp/memberlist"
+	"github.com/byte-mug/golibs/bufferex"
+	"sort"
+	"testing"
+	"time"
+)
+
+/*
+Answers mhTest requests (requester, call-id) with mhOther call-id name.
+*/
+func echo(w *mlst.WrapNode) {
+	w.Handlers[mhTest] = func(w *mlst.WrapNode,d *mlst.MessageReader, msg bufferex.Binary) bool {
+		from,err := d.DecodeString()
+		if err!=nil { return false }
+		id,err := d.DecodeUint64()
+		if err!=nil { return false }
+		go func() {
+			mb := new(mlst.MessageBuffer).Init()
+			mb.EncodeMulti(mhOther,id,w.Name)
+			if nd := w.Lookup(from); nd!=nil { w.SendTo(mlst.ST_Reliable,nd,mb.Bytes()) }
+		}()
+		return false
+	}
+}
+
+func request(w *mlst.WrapNode) func(id uint64) []byte {
+	return func(id uint64) []byte {
+		mb := new(mlst.MessageBuffer).Init()
+		mb.EncodeMulti(mhTest,w.Name,id)
+		return mb.Bytes()
+	}
+}
+
+func TestRequestMany(t *testing.T) {
+	c := cluster(t,3,func(i int, wn *mlst.WrapNode, cfg *memberlist.Config) { echo(wn) })
+	w := c.Nodes[0]
+	w.Handlers[mhOther] = w.Calls.Deliver
+	nodes := []*memberlist.Node{lookup(t,w,"node-1"),lookup(t,w,"node-2"),nil}
+	
+	rs,errs := w.RequestMany(mlst.ST_BestFit,nodes,3,time.Second,request(w))
+	if errs[0]!=nil || errs[1]!=nil { t.Fatal(errs) }
+	if errs[2]!=mlst.ErrNoNode { t.Fatalf("sending to nil: %v",errs[2]) }
+	var names []string
+	for _,r := range rs {
+		name,err := r.DecodeString()
+		if err!=nil { t.Fatal(err) }
+		names = append(names,name)
+		r.Free()
+	}
+	sort.Strings(names)
+	if len(names)!=2 || names[0]!="node-1" || names[1]!="node-2" { t.Fatalf("replies from %v",names) }
+	
+	// With k=1, it returns after the first reply. The second one is discarded.
+	rs,_ = w.RequestMany(mlst.ST_BestFit,nodes[:2],1,time.Second,request(w))
+	if len(rs)!=1 { t.Fatalf("%d replies, want 1",len(rs)) }
+	rs[0].Free()
+}
+
+func TestRequestManyTimeout(t *testing.T) {
+	c := cluster(t,2,nil) // node-1 does not answer.
+	w := c.Nodes[0]
+	w.Handlers[mhOther] = w.Calls.Deliver
+	start := time.Now()
+	rs,errs := w.RequestMany(mlst.ST_BestFit,[]*memberlist.Node{lookup(t,w,"node-1")},1,time.Millisecond*100,request(w))
+	if errs[0]!=nil { t.Fatal(errs[0]) }
+	if len(rs)!=0 { t.Fatal("reply from a node without handler") }
+	if d := time.Since(start); d<time.Millisecond*100 { t.Fatalf("returned after %v",d) }
+}
+
+/*
+Chain passes messages, that are not a reply to a pending call, to the previous handler.
+*/
+func TestCallChain(t *testing.T) {
+	c := cluster(t,2,func(i int, wn *mlst.WrapNode, cfg *memberlist.Config) { echo(wn) })
+	w := c.Nodes[0]
+	prev := count(w,mhOther)
+	w.Handlers[mhOther] = w.Calls.Chain(w.Handlers[mhOther])
+	n1 := lookup(t,w,"node-1")
+	
+	rs,_ := w.RequestMany(mlst.ST_BestFit,[]*memberlist.Node{n1},1,time.Second,request(w))
+	if len(rs)!=1 { t.Fatal("no reply") }
+	rs[0].Free()
+	if prev.value()!=0 { t.Fatal("a reply reached the previous handler") }
+	
+	// A message, that is not a reply.
+	c.Nodes[1].SendTo(mlst.ST_Reliable,lookup(t,c.Nodes[1],"node-0"),message(mhOther,"stray"))
+	if prev.settle()!=1 { t.Fatal("a stray message did not reach the previous handler") }
+}
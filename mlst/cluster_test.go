@@ -0,0 +1,100 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst_test
+
+import (
+	"github.com/byte-mug/cherdy/mlst"
+	"github.com/byte-mug/cherdy/simnet"
+	"github.com/hashicorp/memberlist"
+	"github.com/byte-mug/golibs/bufferex"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+Message headers, that are only used by the tests.
+*/
+const (
+	mhTest = 0x7f000 + iota
+	mhOther
+)
+
+/*
+Starts a cluster of n nodes on a simulated network and waits, until it has converged.
+*/
+func cluster(t *testing.T, n int, setup simnet.Setup) *simnet.Cluster {
+	c,err := simnet.NewCluster(simnet.NewNetwork(1),n,setup)
+	if err!=nil { t.Fatal(err) }
+	t.Cleanup(c.Shutdown)
+	if err = c.WaitMembers(n,time.Second*5); err!=nil { t.Fatal(err) }
+	return c
+}
+
+/*
+Counts the messages with the given header, a node has received.
+*/
+type counter struct{
+	n  uint64
+	ch chan []byte
+}
+func count(w *mlst.WrapNode, header uint64) *counter {
+	c := &counter{ch:make(chan []byte,1024)}
+	w.Handlers[header] = func(w *mlst.WrapNode,d *mlst.MessageReader, msg bufferex.Binary) bool {
+		atomic.AddUint64(&c.n,1)
+		rest,_ := d.DecodeBytes()
+		select {
+		case c.ch <- append([]byte(nil),rest...):
+		default:
+		}
+		return false
+	}
+	return c
+}
+func (c *counter) value() uint64 { return atomic.LoadUint64(&c.n) }
+
+/*
+Waits, until the counter stops changing.
+*/
+func (c *counter) settle() uint64 {
+	v := c.value()
+	for {
+		time.Sleep(time.Millisecond*100)
+		n := c.value()
+		if n==v { return n }
+		v = n
+	}
+}
+
+func message(header uint64, payload string) []byte {
+	mb := new(mlst.MessageBuffer).Init()
+	mb.EncodeMulti(header,[]byte(payload))
+	return mb.Bytes()
+}
+
+func lookup(t *testing.T, w *mlst.WrapNode, name string) *memberlist.Node {
+	nd := w.Lookup(name)
+	if nd==nil { t.Fatalf("%s does not know %s",w.Name,name) }
+	return nd
+}
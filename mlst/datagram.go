@@ -0,0 +1,68 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst
+
+import (
+	"github.com/hashicorp/memberlist"
+)
+
+/*
+Used, if the memberlist config is unknown.
+*/
+const DefaultDatagramSize = 912
+
+/*
+Overhead, that memberlist adds to a user message sent as datagram.
+*/
+const (
+	dgUserMsg  = 1   // Message type.
+	dgCompound = 2+2 // Compound header and entry length, if gossip is piggybacked.
+	dgCRC      = 5   // Message type and CRC32 (protocol version 5 and above).
+	dgEncrypt  = 45  // Version, IV, padding and tag (worst case of all encryption versions).
+)
+
+/*
+Returns the largest message, that can be sent as a single datagram, without
+exceeding cfg.UDPBufferSize.
+
+Compression is not taken into account, as memberlist only uses it, if the message
+gets smaller.
+*/
+func DatagramSize(cfg *memberlist.Config) int {
+	n := cfg.UDPBufferSize - dgUserMsg - dgCompound - dgCRC
+	if cfg.Label!="" { n -= 2+len(cfg.Label) }
+	encrypted := len(cfg.SecretKey)!=0 || cfg.EncryptionEnabled()
+	if encrypted && cfg.GossipVerifyOutgoing { n -= dgEncrypt }
+	if n<0 { n = 0 }
+	return n
+}
+
+/*
+Returns the largest message, that ST_BestFit and ST_Fast send as datagram.
+*/
+func (w *WrapNode) DatagramLimit() int {
+	if w.MaxDatagram>0 { return w.MaxDatagram }
+	return DefaultDatagramSize
+}
+
@@ -0,0 +1,74 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst_test
+
+import (
+	"github.com/byte-mug/cherdy/mlst"
+	"github.com/hashicorp/memberlist"
+	"strings"
+	"testing"
+)
+
+func TestDatagramSize(t *testing.T) {
+	cfg := memberlist.DefaultLANConfig()
+	cfg.UDPBufferSize = 1400
+	plain := mlst.DatagramSize(cfg)
+	if plain!=1400-1-4-5 { t.Fatalf("DatagramSize = %d",plain) }
+	cfg.Label = "ab"
+	if n := mlst.DatagramSize(cfg); n!=plain-4 { t.Fatalf("with label: %d, want %d",n,plain-4) }
+	cfg.SecretKey = make([]byte,16)
+	if n := mlst.DatagramSize(cfg); n!=plain-4-45 { t.Fatalf("encrypted: %d, want %d",n,plain-4-45) }
+	cfg.UDPBufferSize = 10
+	if mlst.DatagramSize(cfg)!=0 { t.Fatal("negative size") }
+}
+
+/*
+The limit is derived from the config and decides, whether ST_BestFit uses a
+datagram.
+*/
+func TestDatagramLimit(t *testing.T) {
+	c := cluster(t,2,func(i int, wn *mlst.WrapNode, cfg *memberlist.Config) { cfg.UDPBufferSize = 600 })
+	w := c.Nodes[0]
+	if w.DatagramLimit()!=600-1-4-5 { t.Fatalf("DatagramLimit = %d",w.DatagramLimit()) }
+	recv := count(c.Nodes[1],mhTest)
+	var used []mlst.SendType
+	w.SetInterceptor(func(st mlst.SendType,to *memberlist.Node, msg []byte, send mlst.SendFunc) error {
+		used = append(used,st)
+		return send(st,to,msg)
+	})
+	n1 := lookup(t,w,"node-1")
+	small,large := message(mhTest,"x"),message(mhTest,strings.Repeat("x",w.DatagramLimit()))
+	for _,st := range []mlst.SendType{mlst.ST_BestFit,mlst.ST_Fast} {
+		if err := w.SendTo(st,n1,small); err!=nil { t.Fatal(err) }
+		if err := w.SendTo(st,n1,large); err!=nil { t.Fatal(err) }
+	}
+	want := []mlst.SendType{mlst.ST_Datagram,mlst.ST_NoDatagram,mlst.ST_Datagram,mlst.ST_Fast}
+	for i := range want {
+		if used[i]!=want[i] { t.Fatalf("send types %v, want %v",used,want) }
+	}
+	if recv.settle()!=4 { t.Fatal("messages lost") }
+	
+	var x mlst.WrapNode
+	if x.DatagramLimit()!=mlst.DefaultDatagramSize { t.Fatal("no default without a config") }
+}
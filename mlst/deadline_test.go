@@ -0,0 +1,86 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst_test
+
+import (
+	"context"
+	"github.com/byte-mug/cherdy/mlst"
+	"github.com/byte-mug/golibs/bufferex"
+	"testing"
+	"time"
+)
+
+type received struct{
+	deadline time.Time
+	ok       bool
+	expired  bool
+	fwd      []byte
+}
+
+func TestDeadline(t *testing.T) {
+	c := cluster(t,2,nil)
+	got := make(chan received,4)
+	c.Nodes[0].Handlers[mhTest] = func(w *mlst.WrapNode,d *mlst.MessageReader, msg bufferex.Binary) bool {
+		var r received
+		r.deadline,r.ok = d.Context().Deadline()
+		r.expired = d.Context().Err()!=nil
+		// Forward the envelope, as a node would do, that passes the request on.
+		mb := new(mlst.MessageBuffer).Init()
+		mb.EncodeEnvelope(d)
+		r.fwd = mb.Bytes()
+		got <- r
+		return false
+	}
+	w := c.Nodes[1]
+	n0 := lookup(t,w,"node-0")
+	send := func(ctx context.Context) received {
+		mb := new(mlst.MessageBuffer).Init()
+		mb.EncodeContext(ctx)
+		mb.EncodeMulti(mhTest,[]byte("x"))
+		if err := w.SendTo(mlst.ST_Reliable,n0,mb.Bytes()); err!=nil { t.Fatal(err) }
+		select {
+		case r := <-got: return r
+		case <-time.After(time.Second): t.Fatal("message not received")
+		}
+		panic("unreachable")
+	}
+	
+	if r := send(context.Background()); r.ok || len(r.fwd)!=0 { t.Fatal("a message without deadline has one") }
+	
+	ctx,cancel := context.WithTimeout(context.Background(),time.Second*10)
+	defer cancel()
+	want,_ := ctx.Deadline()
+	r := send(ctx)
+	if !r.ok { t.Fatal("the deadline has been lost") }
+	// The remaining time is sent, so the transmission delay is not accounted for.
+	if r.deadline.After(want.Add(time.Second)) || r.deadline.Before(want) { t.Fatalf("deadline %v, want about %v",r.deadline,want) }
+	if r.expired { t.Fatal("expired too early") }
+	if len(r.fwd)==0 { t.Fatal("the deadline is not forwarded") }
+	if h,ok := mlst.PeekHeader(append(r.fwd,message(mhTest,"x")...)); !ok || h!=mhTest { t.Fatal("the forwarded envelope is not skipped by PeekHeader") }
+	
+	ctx,cancel = context.WithTimeout(context.Background(),time.Millisecond)
+	defer cancel()
+	time.Sleep(time.Millisecond*2)
+	if r := send(ctx); !r.ok || !r.expired { t.Fatal("an expired deadline arrived alive") }
+}
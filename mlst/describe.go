@@ -0,0 +1,155 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+/*
+Describes the layout of a message, so it can be rendered by Describe.
+*/
+type Schema struct{
+	Name   string
+	Fields []string
+	
+	// If true, the fields are followed by another message header.
+	// This is the case for envelope and routing headers.
+	Prefix bool
+}
+
+var (
+	schemaLck sync.RWMutex
+	schemas = make(map[uint64]*Schema)
+)
+
+/*
+Registers the schema of a message header. Plugins call this from init().
+*/
+func RegisterSchema(header uint64, s Schema) {
+	schemaLck.Lock()
+	defer schemaLck.Unlock()
+	schemas[header] = &s
+}
+
+func lookupSchema(header uint64) *Schema {
+	schemaLck.RLock()
+	defer schemaLck.RUnlock()
+	return schemas[header]
+}
+
+func init() {
+	RegisterSchema(MH_Origin,Schema{Name:"MH_Origin",Fields:[]string{"origin"},Prefix:true})
+	RegisterSchema(MH_Deadline,Schema{Name:"MH_Deadline",Fields:[]string{"timeout"},Prefix:true})
+	RegisterSchema(MH_Trace,Schema{Name:"MH_Trace",Fields:[]string{"trace","parent"},Prefix:true})
+}
+
+/*
+Returns the schema name of the header or its hexadecimal representation.
+*/
+func spanName(header uint64) string {
+	if s := lookupSchema(header); s!=nil { return s.Name }
+	return Hex(header).String()
+}
+
+func describeValue(v interface{}) string {
+	switch x := v.(type) {
+	case string: return fmt.Sprintf("%q",x)
+	case []byte:
+		if utf8.Valid(x) { return fmt.Sprintf("b%q",x) }
+		return "0x"+hex.EncodeToString(x)
+	case []interface{}:
+		s := make([]string,len(x))
+		for i,e := range x { s[i] = describeValue(e) }
+		return "["+strings.Join(s," ")+"]"
+	}
+	return fmt.Sprint(v)
+}
+
+/*
+Renders a message in human-readable form, such as:
+
+	MH_Origin{origin:"node-1"} MH_Get{hashnum:3 key:b"foo" target:"node-1" targid:42}
+
+Messages without a registered schema are rendered with their numeric header and
+the values following it.
+*/
+func Describe(msg []byte) string {
+	var sb strings.Builder
+	dec := ReadMessage(msg)
+	value := func() (string,bool) {
+		if dec.Len()==0 { return "",false }
+		v,err := dec.DecodeInterface()
+		if err!=nil { return "<malformed>",false }
+		return describeValue(v),true
+	}
+	rest := func() {
+		var vs []string
+		for {
+			v,ok := value()
+			if v!="" { vs = append(vs,v) }
+			if !ok { break }
+		}
+		if len(vs)!=0 { sb.WriteString("["+strings.Join(vs," ")+"]") }
+	}
+	for dec.Len()>0 {
+		h,err := dec.DecodeUint64()
+		if sb.Len()>0 { sb.WriteByte(' ') }
+		if err!=nil { sb.WriteString("<malformed>"); break }
+		s := lookupSchema(h)
+		if s==nil {
+			fmt.Fprintf(&sb,"0x%x",h)
+			rest()
+			break
+		}
+		sb.WriteString(s.Name)
+		sb.WriteByte('{')
+		for i,f := range s.Fields {
+			v,ok := value()
+			if !ok {
+				if v!="" && i>0 { sb.WriteByte(' ') }
+				sb.WriteString(v)
+				break
+			}
+			if i>0 { sb.WriteByte(' ') }
+			sb.WriteString(f+":"+v)
+		}
+		sb.WriteByte('}')
+		if s.Prefix { continue }
+		rest()
+		break
+	}
+	return sb.String()
+}
+
+func (r *Record) String() string {
+	dir := "<-"
+	if r.Dir==DirSend { dir = "->" }
+	return fmt.Sprintf("%s %s %q %s",r.Time.Format("15:04:05.000000"),dir,r.Peer,Describe(r.Data))
+}
+
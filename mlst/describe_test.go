@@ -0,0 +1,57 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst_test
+
+import (
+	"github.com/byte-mug/cherdy/mlst"
+	"testing"
+)
+
+const mhDescribed = 0x7f100
+
+func init() {
+	mlst.RegisterSchema(mhDescribed,mlst.Schema{Name:"MH_Described",Fields:[]string{"key","id"}})
+}
+
+func TestDescribe(t *testing.T) {
+	enc := func(vs ...interface{}) []byte {
+		mb := new(mlst.MessageBuffer).Init()
+		mb.EncodeMulti(vs...)
+		return mb.Bytes()
+	}
+	for _,c := range []struct{
+		msg  []byte
+		want string
+	}{
+		{enc(mhDescribed,[]byte("foo"),42),`MH_Described{key:b"foo" id:42}`},
+		{enc(mlst.MH_Origin,"node-1",mhDescribed,[]byte("foo"),42),`MH_Origin{origin:"node-1"} MH_Described{key:b"foo" id:42}`},
+		{enc(mhDescribed,[]byte{0xff,0x00},1),`MH_Described{key:0xff00 id:1}`},
+		{enc(mhDescribed,[]byte("k")),`MH_Described{key:b"k"}`},
+		{enc(mhDescribed,[]byte("k"),1,"more",2),`MH_Described{key:b"k" id:1}["more" 2]`},
+		{enc(mhOther,[]byte("x"),[]interface{}{1,"y"}),`0x7f001[b"x" [1 "y"]]`},
+		{append(enc(mhDescribed,[]byte("k")),0xc1),`MH_Described{key:b"k" <malformed>}`},
+	}{
+		if got := mlst.Describe(c.msg); got!=c.want { t.Errorf("Describe = %s, want %s",got,c.want) }
+	}
+}
@@ -0,0 +1,166 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst
+
+import (
+	"github.com/byte-mug/golibs/bufferex"
+	"context"
+	"time"
+)
+
+/*
+Envelope headers. They precede the actual message header and carry information
+about the message itself. They are processed by mlst.
+*/
+const (
+	MH_Origin = 0x1000 + iota // Name of the sending node.
+	MH_Deadline // Remaining time in nanoseconds, until the sender gives up.
+	MH_Trace // Trace-ID and ID of the parent span.
+)
+
+/*
+Control messages.
+*/
+const (
+	MH_Ping = 0x1100 + iota
+	MH_Pong
+	MH_Relay // Destination and hop limit, followed by the relayed message.
+)
+
+/*
+Number of fields following each envelope header.
+*/
+var envelopeFields = map[uint64]int{
+	MH_Origin: 1,
+	MH_Deadline: 1,
+	MH_Trace: 2,
+}
+
+func isEnvelope(i uint64) bool {
+	_,ok := envelopeFields[i]
+	return ok
+}
+
+/*
+Returns the first message header of msg, that is not an envelope header.
+*/
+func PeekHeader(msg []byte) (uint64,bool) {
+	h,_,ok := peekMessage(msg)
+	return h,ok
+}
+
+/*
+Returns the first message header, that is not an envelope header, and the origin.
+*/
+func peekMessage(msg []byte) (h uint64, org string, ok bool) {
+	dec := ReadMessage(msg)
+	for {
+		i,e := dec.DecodeUint64()
+		if e!=nil { return }
+		n,isenv := envelopeFields[i]
+		if !isenv { return i,org,true }
+		if i==MH_Origin {
+			org,e = dec.DecodeString()
+			if e!=nil { return }
+			n--
+		}
+		for ; n>0; n-- {
+			if dec.Skip()!=nil { return }
+		}
+	}
+}
+
+func origin(w *WrapNode,d *MessageReader, msg bufferex.Binary) bool {
+	o,err := d.DecodeString()
+	if err!=nil { return false }
+	d.Origin = o
+	return true
+}
+
+// The encoded MH_Origin header, without the name.
+var originPrefix = func() []byte {
+	mb := new(MessageBuffer).Init()
+	mb.EncodeMulti(MH_Origin)
+	return mb.Bytes()
+}()
+
+/*
+Returns a new MessageBuffer for a message, that is sent by this node. If
+StampOrigin is enabled, the MH_Origin header has already been written, so SendTo
+does not have to copy the message.
+*/
+func (w *WrapNode) NewMessage() *MessageBuffer {
+	mb := new(MessageBuffer).Init()
+	if w.StampOrigin { mb.EncodeMulti(MH_Origin,w.Name) }
+	return mb
+}
+
+func (w *WrapNode) stampOrigin(msg []byte) []byte {
+	mb := w.NewMessage()
+	mb.Write(msg)
+	return mb.Bytes()
+}
+
+func deadline(w *WrapNode,d *MessageReader, msg bufferex.Binary) bool {
+	ns,err := d.DecodeInt64()
+	if err!=nil { return false }
+	d.setDeadline(time.Now().Add(time.Duration(ns)))
+	return true
+}
+
+func (r *MessageReader) setDeadline(t time.Time) {
+	if r.cancel!=nil { r.cancel() }
+	r.ctx,r.cancel = context.WithDeadline(context.Background(),t)
+}
+
+/*
+Returns the context of the message. If the message carries a deadline, the
+context expires, when the sender gives up.
+*/
+func (r *MessageReader) Context() context.Context {
+	if r.ctx==nil { return context.Background() }
+	return r.ctx
+}
+
+/*
+Writes the envelope headers for ctx. Must be called before the message header is
+written. If ctx has no deadline, nothing is written.
+*/
+func (m *MessageBuffer) EncodeContext(ctx context.Context) {
+	if t,ok := ctx.Deadline(); ok {
+		rem := time.Until(t)
+		if rem<0 { rem = 0 }
+		m.EncodeMulti(MH_Deadline,int64(rem))
+	}
+}
+
+/*
+Writes the envelope headers of a received message. This is used, when a message is
+forwarded to another node. Must be called before the message header is written.
+*/
+func (m *MessageBuffer) EncodeEnvelope(d *MessageReader) {
+	m.EncodeContext(d.Context())
+	if !d.trace.IsZero() { m.EncodeMulti(MH_Trace,d.trace[:],d.span) }
+}
+
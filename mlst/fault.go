@@ -0,0 +1,154 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst
+
+import (
+	"github.com/hashicorp/memberlist"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+/*
+A Fault describes, what should happen to matching messages.
+Probabilities are in the range 0.0 - 1.0.
+*/
+type Fault struct{
+	Peer   string // The name of the receiving node. "" matches any node.
+	Header uint64 // The first message header. 0 matches any message.
+	
+	Drop      float64 // Probability, that the message is lost.
+	Duplicate float64 // Probability, that the message is sent twice.
+	Corrupt   float64 // Probability, that one byte of the message is flipped.
+	
+	Delay  time.Duration // Fixed delay.
+	Jitter time.Duration // Random additional delay. Causes reordering.
+}
+func (f *Fault) match(to *memberlist.Node, msg []byte) bool {
+	if f.Peer!="" && (to==nil || to.Name!=f.Peer) { return false }
+	if f.Header!=0 {
+		h,ok := PeekHeader(msg)
+		if !ok || h!=f.Header { return false }
+	}
+	return true
+}
+
+/*
+A FaultInjector is used for chaos testing. It is installed using:
+
+	fi := mlst.NewFaultInjector(seed)
+	wn.SetInterceptor(fi.Intercept)
+
+The faults can be changed at any time. For every message the first matching
+fault is applied. Messages, that don't match any fault are sent unmodified.
+*/
+type FaultInjector struct{
+	lck    sync.Mutex
+	rnd    *rand.Rand
+	faults []Fault
+}
+
+func NewFaultInjector(seed int64) *FaultInjector {
+	return &FaultInjector{rnd:rand.New(rand.NewSource(seed))}
+}
+
+/*
+Replaces all faults.
+*/
+func (f *FaultInjector) Set(faults ...Fault) {
+	f.lck.Lock()
+	defer f.lck.Unlock()
+	f.faults = append([]Fault(nil),faults...)
+}
+
+/*
+Adds a fault. It has a lower priority than the faults already added.
+*/
+func (f *FaultInjector) Add(fault Fault) {
+	f.lck.Lock()
+	defer f.lck.Unlock()
+	f.faults = append(f.faults,fault)
+}
+
+/*
+Removes all faults.
+*/
+func (f *FaultInjector) Clear() { f.Set() }
+
+type faultAction struct{
+	drop, dup bool
+	corrupt   int // -1 = no corruption
+	delay     time.Duration
+}
+
+func (f *FaultInjector) decide(to *memberlist.Node, msg []byte) (a faultAction,ok bool) {
+	f.lck.Lock()
+	defer f.lck.Unlock()
+	a.corrupt = -1
+	for i := range f.faults {
+		ft := &f.faults[i]
+		if !ft.match(to,msg) { continue }
+		ok = true
+		a.drop = f.rnd.Float64()<ft.Drop
+		a.dup = f.rnd.Float64()<ft.Duplicate
+		if len(msg)>0 && f.rnd.Float64()<ft.Corrupt { a.corrupt = f.rnd.Intn(len(msg)) }
+		a.delay = ft.Delay
+		if ft.Jitter>0 { a.delay += time.Duration(f.rnd.Int63n(int64(ft.Jitter))) }
+		return
+	}
+	return
+}
+
+/*
+Implements Interceptor.
+
+Dropped and delayed messages are reported as successfully sent, just like a lossy
+network would do.
+*/
+func (f *FaultInjector) Intercept(st SendType,to *memberlist.Node, msg []byte, send SendFunc) error {
+	a,ok := f.decide(to,msg)
+	if !ok { return send(st,to,msg) }
+	if a.drop { return nil }
+	if a.corrupt>=0 || a.delay>0 {
+		// The caller may reuse msg, once we have returned.
+		cpy := make([]byte,len(msg))
+		copy(cpy,msg)
+		if a.corrupt>=0 { cpy[a.corrupt] ^= 0xff }
+		msg = cpy
+	}
+	n := 1
+	if a.dup { n = 2 }
+	if a.delay>0 {
+		time.AfterFunc(a.delay,func() {
+			for i := 0; i<n; i++ { send(st,to,msg) }
+		})
+		return nil
+	}
+	var err error
+	for i := 0; i<n; i++ { err = send(st,to,msg) }
+	return err
+}
+
+var _ Interceptor = (*FaultInjector)(nil).Intercept
+
@@ -0,0 +1,103 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst_test
+
+import (
+	"github.com/byte-mug/cherdy/mlst"
+	"github.com/hashicorp/memberlist"
+	"testing"
+	"time"
+)
+
+func TestFaultInjection(t *testing.T) {
+	c := cluster(t,2,nil)
+	w := c.Nodes[1]
+	test,other := count(c.Nodes[0],mhTest),count(c.Nodes[0],mhOther)
+	fi := mlst.NewFaultInjector(1)
+	fi.Set(
+		mlst.Fault{Peer:"node-0",Header:mhTest,Drop:0.5},
+		mlst.Fault{Peer:"node-0",Header:mhOther,Duplicate:1},
+	)
+	w.SetInterceptor(fi.Intercept)
+	n0 := lookup(t,w,"node-0")
+	for i := 0; i<100; i++ {
+		if err := w.SendTo(mlst.ST_Reliable,n0,message(mhTest,"x")); err!=nil { t.Fatal(err) }
+		if err := w.SendTo(mlst.ST_Reliable,n0,message(mhOther,"x")); err!=nil { t.Fatal(err) }
+		time.Sleep(time.Millisecond) // Don't overflow the receive queue.
+	}
+	if n := test.settle(); n==0 || n==100 { t.Fatalf("drop 0.5 delivered %d of 100 messages",n) }
+	if n := other.settle(); n!=200 { t.Fatalf("duplicate 1 delivered %d messages, want 200",n) }
+	
+	// A fault for another peer does not match.
+	fi.Set(mlst.Fault{Peer:"node-2",Drop:1})
+	before := test.value()
+	w.SendTo(mlst.ST_Reliable,n0,message(mhTest,"x"))
+	if n := test.settle(); n!=before+1 { t.Fatal("a fault for another peer dropped the message") }
+}
+
+/*
+The decisions only depend on the seed.
+*/
+func TestFaultInjectorSeed(t *testing.T) {
+	run := func() (sent []string) {
+		fi := mlst.NewFaultInjector(42)
+		fi.Set(mlst.Fault{Drop:0.3,Corrupt:0.3})
+		to := &memberlist.Node{Name:"a"}
+		for i := 0; i<64; i++ {
+			fi.Intercept(mlst.ST_Datagram,to,message(mhTest,"payload"),func(st mlst.SendType,to *memberlist.Node, msg []byte) error {
+				sent = append(sent,string(msg))
+				return nil
+			})
+		}
+		return
+	}
+	x,y := run(),run()
+	if len(x)==0 || len(x)==64 { t.Fatalf("drop 0.3 sent %d of 64 messages",len(x)) }
+	if len(x)!=len(y) { t.Fatalf("same seed, %d vs %d messages",len(x),len(y)) }
+	corrupt := 0
+	for i := range x {
+		if x[i]!=y[i] { t.Fatalf("same seed, message %d differs",i) }
+		if x[i]!=string(message(mhTest,"payload")) { corrupt++ }
+	}
+	if corrupt==0 { t.Fatal("corrupt 0.3 never flipped a byte") }
+}
+
+func TestFaultDelay(t *testing.T) {
+	fi := mlst.NewFaultInjector(1)
+	fi.Add(mlst.Fault{Delay:time.Millisecond*50})
+	done := make(chan time.Time,1)
+	start := time.Now()
+	msg := message(mhTest,"x")
+	fi.Intercept(mlst.ST_Datagram,&memberlist.Node{Name:"a"},msg,func(st mlst.SendType,to *memberlist.Node, m []byte) error {
+		if string(m)!=string(message(mhTest,"x")) { t.Error("the delayed message has been modified") }
+		done <- time.Now()
+		return nil
+	})
+	msg[len(msg)-1] ^= 0xff // The caller may reuse the buffer.
+	select {
+	case at := <-done:
+		if at.Sub(start)<time.Millisecond*50 { t.Fatalf("delivered after %v",at.Sub(start)) }
+	case <-time.After(time.Second): t.Fatal("delayed message not sent")
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst
+
+import (
+	"github.com/hashicorp/memberlist"
+	"sync"
+)
+
+const (
+	ev_join = iota
+	ev_update
+	ev_leave
+)
+
+type hookEvent struct{
+	kind int
+	node *memberlist.Node
+}
+
+/*
+A hookQueue delivers events to an asynchronous hook in the order, they have been
+submitted. There is at most one goroutine per queue, that is only running, as long
+as there are events pending. So the memberlist is never blocked by a slow hook.
+*/
+type hookQueue struct{
+	hook memberlist.EventDelegate
+	lck  sync.Mutex
+	evs  []hookEvent
+	busy bool
+}
+func (q *hookQueue) push(ev hookEvent) {
+	q.lck.Lock()
+	defer q.lck.Unlock()
+	q.evs = append(q.evs,ev)
+	if q.busy { return }
+	q.busy = true
+	go q.run()
+}
+func (q *hookQueue) pop() (ev hookEvent,ok bool) {
+	q.lck.Lock()
+	defer q.lck.Unlock()
+	if len(q.evs)==0 {
+		q.busy = false
+		q.evs = nil
+		return
+	}
+	ev,ok = q.evs[0],true
+	q.evs[0] = hookEvent{}
+	q.evs = q.evs[1:]
+	return
+}
+func (q *hookQueue) run() {
+	for {
+		ev,ok := q.pop()
+		if !ok { return }
+		switch ev.kind {
+		case ev_join: q.hook.NotifyJoin(ev.node)
+		case ev_update: q.hook.NotifyUpdate(ev.node)
+		case ev_leave: q.hook.NotifyLeave(ev.node)
+		}
+	}
+}
+
+/*
+Returns one queue per element of AsyncHooks. Hooks, that have been appended after
+the first event, get their queue on the next event.
+*/
+func (i *InternalNode) hookQueues() []*hookQueue {
+	i.hlck.Lock()
+	defer i.hlck.Unlock()
+	for len(i.hqs)<len(i.AsyncHooks) {
+		i.hqs = append(i.hqs,&hookQueue{hook:i.AsyncHooks[len(i.hqs)]})
+	}
+	return i.hqs
+}
+
+/*
+Submits an event to all AsyncHooks. As memberlist updates its nodes in place, every
+hook receives a copy of the node, as it was at the time of the event.
+*/
+func (i *InternalNode) asyncEvent(kind int, node *memberlist.Node) {
+	hqs := i.hookQueues()
+	if len(hqs)==0 { return }
+	cpy := new(memberlist.Node)
+	*cpy = *node
+	for _,q := range hqs { q.push(hookEvent{kind,cpy}) }
+}
+
@@ -0,0 +1,81 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst
+
+import (
+	"github.com/hashicorp/memberlist"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordHook struct{
+	lck   sync.Mutex
+	evs   []string
+	delay time.Duration
+	done  chan struct{}
+	want  int
+}
+func (r *recordHook) add(ev string) {
+	time.Sleep(r.delay)
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	r.evs = append(r.evs,ev)
+	if len(r.evs)==r.want { close(r.done) }
+}
+func (r *recordHook) NotifyJoin(n *memberlist.Node) { r.add("join "+n.Name+" "+string(n.Meta)) }
+func (r *recordHook) NotifyUpdate(n *memberlist.Node) { r.add("update "+n.Name+" "+string(n.Meta)) }
+func (r *recordHook) NotifyLeave(n *memberlist.Node) { r.add("leave "+n.Name+" "+string(n.Meta)) }
+
+/*
+Every hook sees the events in order and with the node, as it was at the time of the
+event, even if it is slower than the memberlist.
+*/
+func TestAsyncHooksOrder(t *testing.T) {
+	w := new(WrapNode)
+	w.Initialize()
+	slow := &recordHook{delay:time.Millisecond*5,done:make(chan struct{}),want:3}
+	fast := &recordHook{done:make(chan struct{}),want:3}
+	w.Deleg.AsyncHooks = append(w.Deleg.AsyncHooks,slow,fast)
+	
+	start := time.Now()
+	nd := &memberlist.Node{Name:"a",Meta:[]byte("1")}
+	w.Deleg.NotifyJoin(nd)
+	nd.Meta = []byte("2") // memberlist updates its nodes in place.
+	w.Deleg.NotifyUpdate(nd)
+	nd.Meta = []byte("3")
+	w.Deleg.NotifyLeave(nd)
+	if time.Since(start)>=slow.delay { t.Fatal("a slow hook blocked the memberlist") }
+	
+	want := []string{"join a 1","update a 2","leave a 3"}
+	for _,r := range []*recordHook{slow,fast} {
+		select {
+		case <-r.done:
+		case <-time.After(time.Second): t.Fatal("events not delivered")
+		}
+		for i := range want {
+			if r.evs[i]!=want[i] { t.Fatalf("event %d = %q, want %q",i,r.evs[i],want[i]) }
+		}
+	}
+}
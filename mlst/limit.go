@@ -0,0 +1,277 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst
+
+import (
+	"github.com/hashicorp/memberlist"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrRateLimited = errors.New("Rate limit exceeded")
+)
+
+type rateLimit struct{
+	rate, burst float64
+}
+
+/*
+A token bucket, that starts full. It is safe for concurrent use.
+*/
+type TokenBucket struct{
+	lck    sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+/*
+Refills the bucket with rate tokens per second, up to burst tokens, and takes one
+token. Returns false, if the bucket is empty.
+*/
+func (b *TokenBucket) Take(rate, burst float64, now time.Time) bool {
+	b.lck.Lock()
+	defer b.lck.Unlock()
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds()*rate
+		if b.tokens>burst { b.tokens = burst }
+	}
+	b.last = now
+	if b.tokens<1 { return false }
+	b.tokens--
+	return true
+}
+
+type LimiterStats struct{
+	Accepted      uint64 // Received messages, that passed the limiter.
+	DroppedPeer   uint64 // Received messages, dropped by the per-peer limit.
+	DroppedHeader uint64 // Received messages, dropped by the per-header limit.
+	RejectedSend  uint64 // Sends, rejected by the sender-side limit.
+}
+
+/*
+Token-bucket rate limiter for WrapNode. The zero value does not limit anything.
+All limits can be changed at any time. A rate of 0 removes the limit.
+
+The per-peer limit on the receive path is enforced by the transport (see
+Limiter.Transport), keyed by the host of the remote address. It can therefore not
+be evaded by forging the name of the sender. WrapNode.PreStart only wraps the
+transport, if a per-peer limit has been set before; only then it can be changed
+later on.
+*/
+type Limiter struct{
+	lck sync.Mutex
+	
+	peer rateLimit
+	send rateLimit
+	hdr  map[uint64]rateLimit
+	
+	peers map[string]*TokenBucket
+	sends map[string]*TokenBucket
+	hdrs  map[uint64]*TokenBucket
+	
+	stats LimiterStats
+}
+
+/*
+Limits the number of packets and streams received from each peer to rate per
+second, allowing bursts of up to burst messages. This includes the traffic of
+memberlist itself (probes and gossip), which must be accounted for in rate.
+The first limit must be set before WrapNode.PreStart.
+*/
+func (l *Limiter) SetPeerLimit(rate float64, burst int) {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+	l.peer = rateLimit{rate,float64(burst)}
+	l.peers = nil
+}
+
+func (l *Limiter) hasPeerLimit() bool {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+	return l.peer.rate>0
+}
+
+/*
+Limits the number of received messages with the given header to rate per second,
+allowing bursts of up to burst messages.
+*/
+func (l *Limiter) SetHeaderLimit(header uint64, rate float64, burst int) {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+	if l.hdr==nil { l.hdr = make(map[uint64]rateLimit) }
+	if l.hdrs!=nil { delete(l.hdrs,header) }
+	if rate<=0 {
+		delete(l.hdr,header)
+	} else {
+		l.hdr[header] = rateLimit{rate,float64(burst)}
+	}
+}
+
+/*
+Limits the number of messages sent to each peer to rate per second, allowing
+bursts of up to burst messages. SendTo returns ErrRateLimited, if exceeded.
+*/
+func (l *Limiter) SetSendLimit(rate float64, burst int) {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+	l.send = rateLimit{rate,float64(burst)}
+	l.sends = nil
+}
+
+func (l *Limiter) Stats() (s LimiterStats) {
+	s.Accepted      = atomic.LoadUint64(&l.stats.Accepted)
+	s.DroppedPeer   = atomic.LoadUint64(&l.stats.DroppedPeer)
+	s.DroppedHeader = atomic.LoadUint64(&l.stats.DroppedHeader)
+	s.RejectedSend  = atomic.LoadUint64(&l.stats.RejectedSend)
+	return
+}
+
+func takeNamed(m *map[string]*TokenBucket, name string, rl rateLimit, now time.Time) bool {
+	if *m==nil { *m = make(map[string]*TokenBucket) }
+	b := (*m)[name]
+	if b==nil {
+		b = new(TokenBucket)
+		(*m)[name] = b
+	}
+	return b.Take(rl.rate,rl.burst,now)
+}
+
+/*
+Called for every message header on the receive path.
+*/
+func (l *Limiter) allowRecv(d *MessageReader, header uint64) bool {
+	if isEnvelope(header) { return true }
+	l.lck.Lock()
+	defer l.lck.Unlock()
+	now := time.Now()
+	
+	if rl,ok := l.hdr[header]; ok {
+		if l.hdrs==nil { l.hdrs = make(map[uint64]*TokenBucket) }
+		b := l.hdrs[header]
+		if b==nil {
+			b = new(TokenBucket)
+			l.hdrs[header] = b
+		}
+		if !b.Take(rl.rate,rl.burst,now) {
+			atomic.AddUint64(&l.stats.DroppedHeader,1)
+			return false
+		}
+	}
+	atomic.AddUint64(&l.stats.Accepted,1)
+	return true
+}
+
+func (l *Limiter) allowSend(to *memberlist.Node) bool {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+	if l.send.rate<=0 || to==nil { return true }
+	if takeNamed(&l.sends,to.Name,l.send,time.Now()) { return true }
+	atomic.AddUint64(&l.stats.RejectedSend,1)
+	return false
+}
+
+
+/*
+Called for every packet and stream on the transport.
+*/
+func (l *Limiter) allowPeer(addr net.Addr) bool {
+	if addr==nil { return true }
+	host,_,err := net.SplitHostPort(addr.String())
+	if err!=nil { host = addr.String() }
+	l.lck.Lock()
+	defer l.lck.Unlock()
+	if l.peer.rate<=0 { return true }
+	if takeNamed(&l.peers,host,l.peer,time.Now()) { return true }
+	atomic.AddUint64(&l.stats.DroppedPeer,1)
+	return false
+}
+
+/*
+Wraps a memberlist Transport, so that the per-peer limit is applied to every
+incoming packet and stream. Packets over the limit are dropped, streams over the
+limit are closed. WrapNode.PreStart installs this, if a per-peer limit is set.
+*/
+func (l *Limiter) Transport(t memberlist.Transport) memberlist.Transport {
+	lt := &limitTransport{
+		Transport: t,
+		l:         l,
+		packetCh:  make(chan *memberlist.Packet),
+		streamCh:  make(chan net.Conn),
+		done:      make(chan struct{}),
+	}
+	go lt.packets()
+	go lt.streams()
+	return lt
+}
+
+type limitTransport struct{
+	memberlist.Transport
+	l *Limiter
+	
+	packetCh chan *memberlist.Packet
+	streamCh chan net.Conn
+	
+	once sync.Once
+	done chan struct{}
+}
+func (t *limitTransport) packets() {
+	in := t.Transport.PacketCh()
+	for {
+		select {
+		case p := <-in:
+			if !t.l.allowPeer(p.From) { continue }
+			select {
+			case t.packetCh <- p:
+			case <-t.done: return
+			}
+		case <-t.done: return
+		}
+	}
+}
+func (t *limitTransport) streams() {
+	in := t.Transport.StreamCh()
+	for {
+		select {
+		case c := <-in:
+			if !t.l.allowPeer(c.RemoteAddr()) { c.Close(); continue }
+			select {
+			case t.streamCh <- c:
+			case <-t.done: c.Close(); return
+			}
+		case <-t.done: return
+		}
+	}
+}
+func (t *limitTransport) PacketCh() <-chan *memberlist.Packet { return t.packetCh }
+func (t *limitTransport) StreamCh() <-chan net.Conn { return t.streamCh }
+func (t *limitTransport) Shutdown() error {
+	t.once.Do(func() { close(t.done) })
+	return t.Transport.Shutdown()
+}
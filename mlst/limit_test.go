@@ -0,0 +1,106 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst_test
+
+import (
+	"github.com/byte-mug/cherdy/mlst"
+	"github.com/byte-mug/cherdy/simnet"
+	"github.com/hashicorp/memberlist"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var b mlst.TokenBucket
+	now := time.Now()
+	for i := 0; i<3; i++ {
+		if !b.Take(10,3,now) { t.Fatalf("take %d of a full bucket failed",i) }
+	}
+	if b.Take(10,3,now) { t.Fatal("took from an empty bucket") }
+	now = now.Add(time.Millisecond*100)
+	if !b.Take(10,3,now) { t.Fatal("the bucket has not been refilled") }
+	if b.Take(10,3,now) { t.Fatal("refilled more than rate allows") }
+	if !b.Take(10,3,now.Add(time.Hour)) || !b.Take(10,3,now.Add(time.Hour)) || !b.Take(10,3,now.Add(time.Hour)) { t.Fatal("the bucket has not been refilled up to burst") }
+	if b.Take(10,3,now.Add(time.Hour)) { t.Fatal("refilled beyond burst") }
+}
+
+func TestSendLimit(t *testing.T) {
+	c := cluster(t,2,nil)
+	w := c.Nodes[1]
+	n0 := lookup(t,w,"node-0")
+	w.Limits.SetSendLimit(0.001,5)
+	for i := 0; i<5; i++ {
+		if err := w.SendTo(mlst.ST_Reliable,n0,message(mhTest,"x")); err!=nil { t.Fatal(err) }
+	}
+	if err := w.SendTo(mlst.ST_Reliable,n0,message(mhTest,"x")); err!=mlst.ErrRateLimited { t.Fatalf("6th send: %v",err) }
+	if s := w.Limits.Stats(); s.RejectedSend!=1 { t.Fatalf("RejectedSend = %d",s.RejectedSend) }
+	
+	w.Limits.SetSendLimit(0,0)
+	if err := w.SendTo(mlst.ST_Reliable,n0,message(mhTest,"x")); err!=nil { t.Fatalf("after removing the limit: %v",err) }
+}
+
+func TestHeaderLimit(t *testing.T) {
+	c := cluster(t,2,nil)
+	test,other := count(c.Nodes[0],mhTest),count(c.Nodes[0],mhOther)
+	c.Nodes[0].Limits.SetHeaderLimit(mhTest,0.001,3)
+	w := c.Nodes[1]
+	n0 := lookup(t,w,"node-0")
+	for i := 0; i<10; i++ {
+		w.SendTo(mlst.ST_Reliable,n0,message(mhTest,"x"))
+		w.SendTo(mlst.ST_Reliable,n0,message(mhOther,"x"))
+	}
+	if n := test.settle(); n!=3 { t.Fatalf("%d limited messages received, want 3",n) }
+	if n := other.settle(); n!=10 { t.Fatalf("%d unlimited messages received, want 10",n) }
+	if s := c.Nodes[0].Limits.Stats(); s.DroppedHeader!=7 { t.Fatalf("DroppedHeader = %d",s.DroppedHeader) }
+}
+
+/*
+The per-peer limit also applies to the traffic of memberlist, so only a few of the
+messages make it through.
+*/
+func TestPeerLimit(t *testing.T) {
+	// Set a limit before the start, so that the transport is wrapped, and tighten
+	// it after the cluster has converged.
+	c := cluster(t,2,func(i int, wn *mlst.WrapNode, cfg *memberlist.Config) { wn.Limits.SetPeerLimit(1e6,1e6) })
+	test := count(c.Nodes[0],mhTest)
+	c.Nodes[0].Limits.SetPeerLimit(0.001,5)
+	w := c.Nodes[1]
+	n0 := lookup(t,w,"node-0")
+	for i := 0; i<20; i++ { w.SendTo(mlst.ST_Datagram,n0,message(mhTest,"x")) }
+	if n := test.settle(); n>5 { t.Fatalf("%d messages passed a burst of 5",n) }
+	if s := c.Nodes[0].Limits.Stats(); s.DroppedPeer<15 { t.Fatalf("DroppedPeer = %d",s.DroppedPeer) }
+}
+
+/*
+Without a per-peer limit, the transport of the config is left alone.
+*/
+func TestPeerLimitTransport(t *testing.T) {
+	cfgs := make([]*memberlist.Config,2)
+	cluster(t,2,func(i int, wn *mlst.WrapNode, cfg *memberlist.Config) {
+		if i==1 { wn.Limits.SetPeerLimit(100,100) }
+		cfgs[i] = cfg
+	})
+	if _,ok := cfgs[0].Transport.(*simnet.Transport); !ok { t.Errorf("transport without a limit: %T",cfgs[0].Transport) }
+	if _,ok := cfgs[1].Transport.(*simnet.Transport); ok { t.Error("the transport with a limit has not been wrapped") }
+}
@@ -0,0 +1,115 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+type Level int
+const (
+	LvDebug Level = iota
+	LvInfo
+	LvWarn
+	LvError
+)
+func (l Level) String() string {
+	switch l {
+	case LvDebug: return "DEBUG"
+	case LvInfo: return "INFO"
+	case LvWarn: return "WARN"
+	case LvError: return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)",int(l))
+}
+
+/*
+A leveled, structured logger. kv is a list of alternating keys and values.
+*/
+type Logger interface{
+	Log(lv Level, msg string, kv ...interface{})
+}
+
+/*
+The logging front-end of WrapNode. Plugins use the Log of the WrapNode, they are
+attached to. The zero value (and a nil *Log) discards everything.
+
+	wn.Log.Logger = mlst.NewStdLogger(os.Stderr,mlst.LvInfo)
+*/
+type Log struct{
+	Logger Logger
+}
+func (l *Log) log(lv Level, msg string, kv []interface{}) {
+	if l==nil || l.Logger==nil { return }
+	l.Logger.Log(lv,msg,kv...)
+}
+func (l *Log) Debug(msg string, kv ...interface{}) { l.log(LvDebug,msg,kv) }
+func (l *Log) Info(msg string, kv ...interface{}) { l.log(LvInfo,msg,kv) }
+func (l *Log) Warn(msg string, kv ...interface{}) { l.log(LvWarn,msg,kv) }
+func (l *Log) Error(msg string, kv ...interface{}) { l.log(LvError,msg,kv) }
+
+/*
+A Logger, that writes lines like
+
+	2019/01/02 15:04:05 WARN message dropped reason=queue-full header=0x10000
+
+to a *log.Logger. Messages below Min are discarded.
+*/
+type StdLogger struct{
+	*log.Logger
+	Min Level
+}
+func NewStdLogger(w io.Writer, min Level) *StdLogger {
+	return &StdLogger{log.New(w,"",log.LstdFlags),min}
+}
+func (s *StdLogger) Log(lv Level, msg string, kv ...interface{}) {
+	if lv<s.Min { return }
+	var sb strings.Builder
+	sb.WriteString(lv.String())
+	sb.WriteByte(' ')
+	sb.WriteString(msg)
+	for i := 0; i<len(kv); i+=2 {
+		var v interface{} = "<missing>"
+		if i+1<len(kv) { v = kv[i+1] }
+		var vs string
+		if b,ok := v.([]byte); ok {
+			vs = fmt.Sprintf("%q",b)
+		} else {
+			vs = fmt.Sprint(v)
+			if strings.ContainsAny(vs," \t\n\"=") || vs=="" { vs = fmt.Sprintf("%q",vs) }
+		}
+		fmt.Fprintf(&sb," %v=%s",kv[i],vs)
+	}
+	s.Output(3,sb.String())
+}
+
+/*
+Formats a message header for logging.
+*/
+type Hex uint64
+func (h Hex) String() string { return fmt.Sprintf("0x%x",uint64(h)) }
+
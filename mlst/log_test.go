@@ -0,0 +1,81 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/byte-mug/cherdy/mlst"
+	"github.com/hashicorp/memberlist"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := mlst.NewStdLogger(&buf,mlst.LvInfo)
+	l.SetFlags(0)
+	lg := &mlst.Log{Logger:l}
+	lg.Debug("hidden")
+	lg.Warn("message dropped","reason","queue-full","header",mlst.Hex(0x10000),"key",[]byte("a b"),"empty","","odd")
+	want := "WARN message dropped reason=queue-full header=0x10000 key=\"a b\" empty=\"\" odd=<missing>\n"
+	if buf.String()!=want { t.Fatalf("got %q, want %q",buf.String(),want) }
+	
+	var nl *mlst.Log
+	nl.Error("a nil Log discards everything")
+	new(mlst.Log).Error("so does the zero value")
+}
+
+type captureLogger struct{
+	lck   sync.Mutex
+	lines []string
+}
+func (c *captureLogger) Log(lv mlst.Level, msg string, kv ...interface{}) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	c.lines = append(c.lines,fmt.Sprint(lv," ",msg," ",kv))
+}
+func (c *captureLogger) find(s string) bool {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	for _,l := range c.lines {
+		if l==s { return true }
+	}
+	return false
+}
+
+func TestLogDropped(t *testing.T) {
+	cl := new(captureLogger)
+	c := cluster(t,2,func(i int, wn *mlst.WrapNode, cfg *memberlist.Config) {
+		if i==0 { wn.Log.Logger = cl }
+	})
+	c.Nodes[1].SendTo(mlst.ST_Reliable,lookup(t,c.Nodes[1],"node-0"),message(mhTest,"x"))
+	want := fmt.Sprint(mlst.LvDebug," message dropped ",[]interface{}{"reason","no-handler","header",mlst.Hex(mhTest),"origin",""})
+	deadline := time.Now().Add(time.Second)
+	for !cl.find(want) {
+		if time.Now().After(deadline) { t.Fatalf("%q not logged",want) }
+		time.Sleep(time.Millisecond*10)
+	}
+}
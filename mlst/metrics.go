@@ -0,0 +1,297 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Default buckets of histograms (in seconds).
+*/
+var DefBuckets = []float64{.0005,.001,.0025,.005,.01,.025,.05,.1,.25,.5,1,2.5}
+
+type metric interface{
+	write(w io.Writer, name, labels string)
+}
+
+type Counter struct{ v uint64 }
+func (c *Counter) Inc() { atomic.AddUint64(&c.v,1) }
+func (c *Counter) Add(n uint64) { atomic.AddUint64(&c.v,n) }
+func (c *Counter) Value() uint64 { return atomic.LoadUint64(&c.v) }
+func (c *Counter) write(w io.Writer, name, labels string) {
+	fmt.Fprintf(w,"%s%s %d\n",name,braces(labels),c.Value())
+}
+
+type Gauge struct{ bits uint64 }
+func (g *Gauge) Set(v float64) { atomic.StoreUint64(&g.bits,math.Float64bits(v)) }
+func (g *Gauge) Add(v float64) {
+	for {
+		o := atomic.LoadUint64(&g.bits)
+		n := math.Float64bits(math.Float64frombits(o)+v)
+		if atomic.CompareAndSwapUint64(&g.bits,o,n) { return }
+	}
+}
+func (g *Gauge) Value() float64 { return math.Float64frombits(atomic.LoadUint64(&g.bits)) }
+func (g *Gauge) write(w io.Writer, name, labels string) {
+	fmt.Fprintf(w,"%s%s %v\n",name,braces(labels),g.Value())
+}
+
+type funcMetric func() float64
+func (f funcMetric) write(w io.Writer, name, labels string) {
+	fmt.Fprintf(w,"%s%s %v\n",name,braces(labels),f())
+}
+
+type Histogram struct{
+	upper  []float64
+	counts []uint64 // len(upper)+1, the last one is +Inf
+	sum    Gauge
+	count  uint64
+}
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upper,v)
+	atomic.AddUint64(&h.counts[i],1)
+	h.sum.Add(v)
+	atomic.AddUint64(&h.count,1)
+}
+func (h *Histogram) write(w io.Writer, name, labels string) {
+	sep := ""
+	if labels!="" { sep = "," }
+	var cum uint64
+	for i,u := range h.upper {
+		cum += atomic.LoadUint64(&h.counts[i])
+		fmt.Fprintf(w,"%s_bucket{%s%sle=\"%v\"} %d\n",name,labels,sep,u,cum)
+	}
+	cum += atomic.LoadUint64(&h.counts[len(h.upper)])
+	fmt.Fprintf(w,"%s_bucket{%s%sle=\"+Inf\"} %d\n",name,labels,sep,cum)
+	fmt.Fprintf(w,"%s_sum%s %v\n",name,braces(labels),h.sum.Value())
+	fmt.Fprintf(w,"%s_count%s %d\n",name,braces(labels),atomic.LoadUint64(&h.count))
+}
+
+func braces(labels string) string {
+	if labels=="" { return "" }
+	return "{"+labels+"}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`,`\\`,`"`,`\"`,"\n",`\n`)
+
+/*
+Formats alternating label names and values.
+*/
+func formatLabels(kv []string) string {
+	var sb strings.Builder
+	for i := 0; i+1<len(kv); i+=2 {
+		if i>0 { sb.WriteByte(',') }
+		sb.WriteString(kv[i])
+		sb.WriteString(`="`)
+		sb.WriteString(labelEscaper.Replace(kv[i+1]))
+		sb.WriteByte('"')
+	}
+	return sb.String()
+}
+
+type family struct{
+	help, typ string
+	metrics   map[string]metric
+}
+
+/*
+A registry of metrics. The zero value is ready to use.
+
+Metrics are identified by their name and their labels, which are given as
+alternating label names and values. Requesting an existing metric returns it.
+
+The Registry is an http.Handler, that exposes all metrics in the Prometheus text
+format:
+
+	http.Handle("/metrics",&wn.Metrics)
+*/
+type Registry struct{
+	lck  sync.Mutex
+	fams map[string]*family
+}
+
+func (r *Registry) get(name, help, typ string, labels []string, mk func() metric) metric {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	if r.fams==nil { r.fams = make(map[string]*family) }
+	f := r.fams[name]
+	if f==nil {
+		f = &family{help:help,typ:typ,metrics:make(map[string]metric)}
+		r.fams[name] = f
+	}
+	if f.typ!=typ { panic("metric "+name+" registered with different types") }
+	l := formatLabels(labels)
+	m := f.metrics[l]
+	if m==nil {
+		m = mk()
+		f.metrics[l] = m
+	}
+	return m
+}
+
+func (r *Registry) Counter(name, help string, labels ...string) *Counter {
+	return r.get(name,help,"counter",labels,func() metric { return new(Counter) }).(*Counter)
+}
+func (r *Registry) Gauge(name, help string, labels ...string) *Gauge {
+	return r.get(name,help,"gauge",labels,func() metric { return new(Gauge) }).(*Gauge)
+}
+
+/*
+Registers a gauge, whose value is obtained by calling f. A second registration
+with the same name and labels is ignored.
+*/
+func (r *Registry) GaugeFunc(name, help string, f func() float64, labels ...string) {
+	r.get(name,help,"gauge",labels,func() metric { return funcMetric(f) })
+}
+
+/*
+Like GaugeFunc, for values, that only increase.
+*/
+func (r *Registry) CounterFunc(name, help string, f func() float64, labels ...string) {
+	r.get(name,help,"counter",labels,func() metric { return funcMetric(f) })
+}
+
+/*
+Returns a histogram. If buckets is nil, DefBuckets is used. The buckets of an
+existing histogram can't be changed.
+*/
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return r.get(name,help,"histogram",labels,func() metric {
+		if buckets==nil { buckets = DefBuckets }
+		u := append([]float64(nil),buckets...)
+		sort.Float64s(u)
+		return &Histogram{upper:u,counts:make([]uint64,len(u)+1)}
+	}).(*Histogram)
+}
+
+/*
+Writes all metrics in the Prometheus text exposition format.
+*/
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	type entry struct{ labels string; m metric }
+	type fam struct{ name string; f *family; ms []entry }
+	
+	// Take a snapshot, so we don't hold the lock while writing.
+	r.lck.Lock()
+	fams := make([]fam,0,len(r.fams))
+	for name,f := range r.fams {
+		ft := fam{name:name,f:f}
+		for l,m := range f.metrics { ft.ms = append(ft.ms,entry{l,m}) }
+		fams = append(fams,ft)
+	}
+	r.lck.Unlock()
+	
+	sort.Slice(fams,func(i,j int) bool { return fams[i].name<fams[j].name })
+	
+	ew := &errWriter{w:w}
+	for _,ft := range fams {
+		sort.Slice(ft.ms,func(i,j int) bool { return ft.ms[i].labels<ft.ms[j].labels })
+		fmt.Fprintf(ew,"# HELP %s %s\n",ft.name,strings.Replace(ft.f.help,"\n",`\n`,-1))
+		fmt.Fprintf(ew,"# TYPE %s %s\n",ft.name,ft.f.typ)
+		for _,e := range ft.ms { e.m.write(ew,ft.name,e.labels) }
+	}
+	return ew.err
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type","text/plain; version=0.0.4")
+	r.WritePrometheus(w)
+}
+
+type errWriter struct{
+	w   io.Writer
+	err error
+}
+func (e *errWriter) Write(p []byte) (int,error) {
+	if e.err!=nil { return 0,e.err }
+	n,err := e.w.Write(p)
+	e.err = err
+	return n,err
+}
+
+const (
+	mDropped = "cherdy_messages_dropped_total"
+	mDroppedHelp = "Received messages, that have been dropped."
+)
+
+/*
+Metrics of the WrapNode, that are used on every message. They are resolved once,
+so the hot paths neither format labels nor take the lock of the Registry.
+*/
+type wrapMetrics struct{
+	droppedLimit, droppedNoHandler *Counter
+}
+
+type headerMetrics struct{
+	received, sent, errors *Counter
+	dispatch *Histogram
+}
+
+/*
+Returns the metrics of a message header. They are created on first use.
+*/
+func (w *WrapNode) headerMetrics(h uint64) *headerMetrics {
+	if hm,ok := w.hms.Load(h); ok { return hm.(*headerMetrics) }
+	hdr := Hex(h).String()
+	hm := &headerMetrics{
+		received: w.Metrics.Counter("cherdy_messages_received_total","Received messages by header.","header",hdr),
+		sent:     w.Metrics.Counter("cherdy_messages_sent_total","Sent messages by header.","header",hdr),
+		errors:   w.Metrics.Counter("cherdy_send_errors_total","Failed sends by header.","header",hdr),
+		dispatch: w.Metrics.Histogram("cherdy_dispatch_duration_seconds","Time spent on the consumer goroutine per message. Handlers, that process messages asynchronously, only account for the dispatch.",nil,"header",hdr),
+	}
+	v,_ := w.hms.LoadOrStore(h,hm)
+	return v.(*headerMetrics)
+}
+
+func (w *WrapNode) registerMetrics() {
+	w.wm.droppedLimit = w.Metrics.Counter(mDropped,mDroppedHelp,"reason","rate-limit")
+	w.wm.droppedNoHandler = w.Metrics.Counter(mDropped,mDroppedHelp,"reason","no-handler")
+	for p := range w.Deleg.Queues {
+		q := w.Deleg.Queues[p]
+		w.Metrics.GaugeFunc("cherdy_queue_depth","Messages waiting in the receive queue.",func() float64 {
+			return float64(len(q))
+		},"priority",Priority(p).String())
+	}
+	w.Metrics.CounterFunc("cherdy_ratelimit_accepted_total","Received messages, that passed the rate limiter.",func() float64 {
+		return float64(w.Limits.Stats().Accepted)
+	})
+	w.Metrics.CounterFunc("cherdy_ratelimit_dropped_total","Received messages, dropped by the rate limiter.",func() float64 {
+		return float64(w.Limits.Stats().DroppedPeer)
+	},"limit","peer")
+	w.Metrics.CounterFunc("cherdy_ratelimit_dropped_total","Received messages, dropped by the rate limiter.",func() float64 {
+		return float64(w.Limits.Stats().DroppedHeader)
+	},"limit","header")
+	w.Metrics.CounterFunc("cherdy_ratelimit_rejected_sends_total","Sends, rejected by the sender-side rate limiter.",func() float64 {
+		return float64(w.Limits.Stats().RejectedSend)
+	})
+}
+
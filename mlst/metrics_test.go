@@ -0,0 +1,104 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst_test
+
+import (
+	"github.com/byte-mug/cherdy/mlst"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	var r mlst.Registry
+	r.Counter("test_total","A counter.","path",`a"b\c`).Add(2)
+	if r.Counter("test_total","A counter.","path",`a"b\c`).Value()!=2 { t.Fatal("requesting a counter again created a new one") }
+	r.Counter("test_total","A counter.","path","x").Inc()
+	r.Gauge("test_gauge","A gauge.").Set(1.5)
+	r.GaugeFunc("test_func","A function.",func() float64 { return 7 })
+	h := r.Histogram("test_seconds","A histogram.",[]float64{2,1})
+	for _,v := range []float64{0.5,1.5,3} { h.Observe(v) }
+	
+	want := `# HELP test_func A function.
+# TYPE test_func gauge
+test_func 7
+# HELP test_gauge A gauge.
+# TYPE test_gauge gauge
+test_gauge 1.5
+# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="1"} 1
+test_seconds_bucket{le="2"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 5
+test_seconds_count 3
+# HELP test_total A counter.
+# TYPE test_total counter
+test_total{path="a\"b\\c"} 2
+test_total{path="x"} 1
+`
+	var sb strings.Builder
+	if err := r.WritePrometheus(&sb); err!=nil { t.Fatal(err) }
+	if sb.String()!=want { t.Fatalf("got\n%s\nwant\n%s",sb.String(),want) }
+	
+	rw := httptest.NewRecorder()
+	r.ServeHTTP(rw,httptest.NewRequest("GET","/metrics",nil))
+	if rw.Body.String()!=want { t.Fatal("ServeHTTP differs from WritePrometheus") }
+	
+	defer func() {
+		if recover()==nil { t.Fatal("registering a name with another type did not panic") }
+	}()
+	r.Gauge("test_total","A counter.")
+}
+
+func TestNodeMetrics(t *testing.T) {
+	c := cluster(t,2,nil)
+	recv := count(c.Nodes[0],mhTest)
+	n0 := lookup(t,c.Nodes[1],"node-0")
+	for i := 0; i<3; i++ { c.Nodes[1].SendTo(mlst.ST_Reliable,n0,message(mhTest,"x")) }
+	c.Nodes[1].SendTo(mlst.ST_Reliable,n0,message(mhOther,"x"))
+	recv.settle()
+	time.Sleep(time.Millisecond*50)
+	
+	expose := func(w *mlst.WrapNode) string {
+		var sb strings.Builder
+		w.Metrics.WritePrometheus(&sb)
+		return sb.String()
+	}
+	for _,l := range []string{
+		`cherdy_messages_sent_total{header="0x7f000"} 3`,
+		`cherdy_messages_sent_total{header="0x7f001"} 1`,
+	}{
+		if !strings.Contains(expose(c.Nodes[1]),l+"\n") { t.Errorf("sender: %s missing",l) }
+	}
+	for _,l := range []string{
+		`cherdy_messages_received_total{header="0x7f000"} 3`,
+		`cherdy_dispatch_duration_seconds_count{header="0x7f000"} 3`,
+		`cherdy_messages_dropped_total{reason="no-handler"} 1`,
+		`cherdy_queue_depth{priority="request"} 0`,
+	}{
+		if !strings.Contains(expose(c.Nodes[0]),l+"\n") { t.Errorf("receiver: %s missing",l) }
+	}
+}
@@ -25,6 +25,7 @@ package mlst
 
 import (
 	"bytes"
+	"sync"
 	xdr "github.com/davecgh/go-xdr/xdr2"
 	"github.com/hashicorp/memberlist"
 	"github.com/byte-mug/golibs/concurrent/sortlist"
@@ -56,10 +57,22 @@ func DecodeNodeMeta(m []byte) (n NodeMeta) {
 type InternalNode struct {
 	Metadata []byte
 	Tlq memberlist.TransmitLimitedQueue
-	Msg chan bufferex.Binary
+	Msg chan bufferex.Binary // == Queues[PrioRequest]
+	Queues [NumPriorities]chan bufferex.Binary
+	Weights [NumPriorities]int
+	Prio map[uint64]Priority
 	Nodes sortlist.Sortlist
 	AsyncHooks []memberlist.EventDelegate
 	SyncHooks []memberlist.EventDelegate
+	
+	hlck sync.Mutex
+	hqs  []*hookQueue
+	
+	log *Log
+	metrics *Registry
+	lat *LatencyTable
+	tap func() *Recorder
+	ping memberlist.PingDelegate
 }
 //func (i *InternalNode)
 func (i *InternalNode) nodes() int {
@@ -67,7 +80,10 @@ func (i *InternalNode) nodes() int {
 }
 func (i *InternalNode) Initialize() {
 	i.Tlq.NumNodes,i.Tlq.RetransmitMult = i.nodes,1
-	i.Msg = make(chan bufferex.Binary,64)
+	for p := range i.Queues { i.Queues[p] = make(chan bufferex.Binary,64) }
+	i.Msg = i.Queues[PrioRequest]
+	i.Weights = DefaultWeights
+	i.Prio = make(map[uint64]Priority)
 	i.Nodes.Cmp = utils.StringComparator
 }
 
@@ -77,15 +93,20 @@ func (i *InternalNode) NodeMeta(limit int) []byte {
 }
 
 func (i *InternalNode) ConsumeB(v bufferex.Binary) {
-	i.Msg <- v
+	i.Queues[i.classify(v)] <- v
 }
 func (i *InternalNode) ConsumeNB(v bufferex.Binary) {
+	p := i.classify(v)
 	select {
-	case i.Msg <- v:
-	default: v.Free()
+	case i.Queues[p] <- v:
+	default:
+		v.Free()
+		i.log.Warn("message dropped","reason","queue-full","priority",p)
+		i.metrics.Counter(mDropped,mDroppedHelp,"reason","queue-full").Inc()
 	}
 }
 func (i *InternalNode) NotifyMsg(b []byte) {
+	i.record(b)
 	v := bufferex.NewBinary(b)
 	i.ConsumeNB(v)
 }
@@ -103,18 +124,18 @@ var _ memberlist.Delegate = (*InternalNode)(nil)
 
 func (i *InternalNode) NotifyJoin(node *memberlist.Node) {
 	i.Nodes.Insert(node.Name,node)
-	for _,h := range i.AsyncHooks { go h.NotifyJoin(node) }
+	i.asyncEvent(ev_join,node)
 	for _,h := range i.SyncHooks { h.NotifyJoin(node) }
 }
 
 func (i *InternalNode) NotifyUpdate(node *memberlist.Node) {
-	for _,h := range i.AsyncHooks { go h.NotifyUpdate(node) }
+	i.asyncEvent(ev_update,node)
 	for _,h := range i.SyncHooks { h.NotifyUpdate(node) }
 }
 
 func (i *InternalNode) NotifyLeave(node *memberlist.Node) {
 	defer i.Nodes.Delete(node.Name)
-	for _,h := range i.AsyncHooks { go h.NotifyLeave(node) }
+	i.asyncEvent(ev_leave,node)
 	for _,h := range i.SyncHooks { h.NotifyLeave(node) }
 }
 
@@ -25,6 +25,11 @@ package mlst
 
 import (
 	"bytes"
+	"context"
+	"log"
+	"os"
+	"sync"
+	"time"
 	"github.com/vmihailenco/msgpack"
 	"github.com/hashicorp/memberlist"
 	"github.com/byte-mug/golibs/bufferex"
@@ -50,6 +55,15 @@ type MessageReader struct{
 	*msgpack.Decoder
 	*bytes.Buffer
 	
+	// The name of the sending node, if the message carries an MH_Origin header.
+	Origin string
+	
+	ctx    context.Context
+	cancel context.CancelFunc
+	
+	trace TraceID
+	span  uint64 // The current span.
+	
 	flags uint
 }
 
@@ -62,7 +76,18 @@ func ReadMessage(b []byte) *MessageReader {
 }
 func RetainBinary(r *MessageReader) { r.flags |= mfr_retain }
 func (r *MessageReader) free(b bufferex.Binary) {
-	if (r.flags&mfr_retain)==0 { b.Free() }
+	if (r.flags&mfr_retain)!=0 { return }
+	r.Release(b)
+}
+
+/*
+Frees a message and the resources of its reader, such as the deadline context.
+A Handler, that retained the message using RetainBinary, must call this instead
+of msg.Free(), once it is done with it.
+*/
+func (r *MessageReader) Release(b bufferex.Binary) {
+	b.Free()
+	if r.cancel!=nil { r.cancel() }
 }
 
 type MessageBuffer struct{
@@ -91,7 +116,7 @@ If the implementor wants to retain the msg value it needs to call:
 
 	mlst.RetainBinary(d)
 
-on the message-reader 'd'.
+on the message-reader 'd'. It must then call d.Release(msg), once it is done.
 */
 type Handler func(w *WrapNode,d *MessageReader, msg bufferex.Binary) bool
 
@@ -116,6 +141,30 @@ type WrapNode struct{
 	Deleg InternalNode
 	Membl *memberlist.Memberlist
 	Handlers map[uint64]Handler
+	Calls CallTable
+	Limits Limiter
+	Log Log
+	Metrics Registry
+	Tracer Tracer
+	Latency LatencyTable
+	Relay Relay
+	
+	// The largest message, that is sent as datagram. If 0, it is derived from
+	// the memberlist config in PreStart. Set it before, to override it.
+	MaxDatagram int
+	
+	cfg *memberlist.Config
+	
+	// If true, every message carries the name of this node. Messages built
+	// with NewMessage already contain it, others are prefixed by SendTo.
+	StampOrigin bool
+	
+	iclck sync.RWMutex
+	ic    Interceptor
+	rec   *Recorder
+	
+	wm  wrapMetrics
+	hms sync.Map // map[uint64]*headerMetrics
 }
 
 // func (w *WrapNode)
@@ -124,7 +173,21 @@ type WrapNode struct{
 func (w *WrapNode) Initialize() {
 	w.Meta = make(NodeMeta)
 	w.Deleg.Initialize()
+	w.Deleg.log = &w.Log
+	w.Deleg.metrics = &w.Metrics
+	w.Deleg.lat = &w.Latency
+	w.Deleg.tap = w.recorder
 	w.Handlers = make(map[uint64]Handler)
+	w.Handlers[MH_Origin] = origin
+	w.Handlers[MH_Deadline] = deadline
+	w.Handlers[MH_Trace] = traceHeader
+	w.Handlers[MH_Ping] = pingHandler
+	w.Handlers[MH_Pong] = pongHandler
+	w.Handlers[MH_Relay] = relayHandler
+	w.SetPriority(MH_Ping,PrioControl)
+	w.SetPriority(MH_Pong,PrioControl)
+	w.Calls.Init()
+	w.registerMetrics()
 }
 
 func (w *WrapNode) Lookup(name string) *memberlist.Node {
@@ -134,9 +197,13 @@ func (w *WrapNode) Lookup(name string) *memberlist.Node {
 }
 
 func (w *WrapNode) SetCfg(cfg *memberlist.Config) {
+	w.cfg = cfg
 	w.Name = cfg.Name
+	w.Tracer.node = cfg.Name
 	cfg.Delegate = &w.Deleg
 	cfg.Events   = &w.Deleg
+	if cfg.Ping!=&w.Deleg { w.Deleg.ping = cfg.Ping } // Wrap an existing PingDelegate.
+	cfg.Ping     = &w.Deleg
 }
 
 /*
@@ -144,6 +211,40 @@ Called, before the memberlist has been created.
 */
 func (w *WrapNode) PreStart() {
 	w.Deleg.Metadata = w.Meta.Bytes()
+	if w.MaxDatagram==0 && w.cfg!=nil { w.MaxDatagram = DatagramSize(w.cfg) }
+	if w.cfg!=nil && w.Limits.hasPeerLimit() { w.limitTransport() }
+}
+
+/*
+Installs the per-peer limit on the transport. If the config has no transport,
+the default transport of memberlist is created here. It is only called, if a
+per-peer limit has been set before PreStart, otherwise the transport is left alone.
+*/
+func (w *WrapNode) limitTransport() {
+	cfg := w.cfg
+	if cfg.Transport==nil {
+		logger := cfg.Logger
+		if logger==nil {
+			out := cfg.LogOutput
+			if out==nil { out = os.Stderr }
+			logger = log.New(out,"",log.LstdFlags)
+		}
+		nt,err := memberlist.NewNetTransport(&memberlist.NetTransportConfig{
+			BindAddrs: []string{cfg.BindAddr},
+			BindPort:  cfg.BindPort,
+			Logger:    logger,
+		})
+		if err!=nil {
+			w.Log.Warn("per-peer rate limiting disabled","err",err)
+			return
+		}
+		if cfg.BindPort==0 {
+			cfg.BindPort = nt.GetAutoBindPort()
+			cfg.AdvertisePort = cfg.BindPort
+		}
+		cfg.Transport = nt
+	}
+	cfg.Transport = w.Limits.Transport(cfg.Transport)
 }
 
 /*
@@ -159,35 +260,119 @@ func (w *WrapNode) consume(msg bufferex.Binary) {
 restart:
 	i,e := dec.DecodeUint64()
 	if e!=nil { return }
+	if !w.Limits.allowRecv(dec,i) {
+		w.Log.Debug("message dropped","reason","rate-limit","header",Hex(i),"origin",dec.Origin)
+		w.wm.droppedLimit.Inc()
+		return
+	}
 	h := w.Handlers[i]
-	if h==nil { return }
-	if h(w,dec,msg) { goto restart }
-}
-
-func (w *WrapNode) consumer() {
-	for msg := range w.Deleg.Msg {
-		w.consume(msg)
+	if h==nil {
+		w.Log.Debug("message dropped","reason","no-handler","header",Hex(i),"origin",dec.Origin)
+		w.wm.droppedNoHandler.Inc()
+		return
 	}
+	hm := w.headerMetrics(i)
+	hm.received.Inc()
+	var sp *Span
+	if !isEnvelope(i) {
+		sp = w.Tracer.Start(dec,spanName(i))
+		if sp!=nil { sp.SetAttr("origin",dec.Origin) }
+	}
+	start := time.Now()
+	next := h(w,dec,msg)
+	sp.Finish()
+	hm.dispatch.Observe(time.Since(start).Seconds())
+	if next { goto restart }
 }
+
 func (w *WrapNode) SendSelf(msg []byte) {
+	w.Deleg.record(msg)
 	n := bufferex.NewBinary(msg)
 	w.Deleg.ConsumeB(n)
 }
+/*
+Transmits a message using the given method, bypassing the Interceptor.
+*/
+type SendFunc func(st SendType,to *memberlist.Node, msg []byte) error
+
+/*
+An Interceptor is called for every message, sent using SendTo. It may drop, delay,
+duplicate or modify the message. In order to send the message, it calls send.
+
+ST_BestFit has already been resolved, when the Interceptor is called.
+*/
+type Interceptor func(st SendType,to *memberlist.Node, msg []byte, send SendFunc) error
+
+/*
+Sets the Interceptor for SendTo. It may be changed at any time. nil disables it.
+*/
+func (w *WrapNode) SetInterceptor(ic Interceptor) {
+	w.iclck.Lock()
+	defer w.iclck.Unlock()
+	w.ic = ic
+}
+func (w *WrapNode) interceptor() Interceptor {
+	w.iclck.RLock()
+	defer w.iclck.RUnlock()
+	return w.ic
+}
+
 func (w *WrapNode) SendTo(st SendType,to *memberlist.Node, msg []byte) error {
+	if !w.Limits.allowSend(to) {
+		w.Log.Debug("send rejected","reason","rate-limit","to",to.Name)
+		return ErrRateLimited
+	}
+	if w.StampOrigin && !bytes.HasPrefix(msg,originPrefix) { msg = w.stampOrigin(msg) }
+	
+	if rec := w.recorder(); rec!=nil { rec.Record(DirSend,to.Name,msg) }
+	
+	rst := w.sendType(st,len(msg))
+	err := w.transmit(rst,to,msg)
+	
+	if err!=nil && w.Relay.Enabled {
+		if w.relay(st,to,msg,w.Relay.maxHops()-1,"")==nil { err = nil }
+	} else if err==nil && rst!=ST_Datagram {
+		// Only reliable transmission proves, that the node is reachable.
+		w.Relay.contact(to.Name)
+	}
+	
+	h,_ := PeekHeader(msg)
+	if err!=nil {
+		w.headerMetrics(h).errors.Inc()
+	} else {
+		w.headerMetrics(h).sent.Inc()
+	}
+	return err
+}
+/*
+Resolves ST_BestFit and ST_Fast for a message of the given size.
+*/
+func (w *WrapNode) sendType(st SendType,size int) SendType {
+	limit := w.DatagramLimit()
 	switch st {
 	case ST_BestFit:
-		if len(msg)<=912 {
+		if size<=limit {
 			st = ST_Datagram
 		} else {
 			st = ST_NoDatagram
 		}
 	case ST_Fast:
-		if len(msg)<=912 {
+		if size<=limit {
 			st = ST_Datagram
 		}
 	}
-	
-	
+	return st
+}
+
+/*
+Sends the message through the Interceptor, if any.
+*/
+func (w *WrapNode) transmit(st SendType,to *memberlist.Node, msg []byte) error {
+	if ic := w.interceptor(); ic!=nil { return ic(st,to,msg,w.send) }
+	return w.send(st,to,msg)
+}
+
+func (w *WrapNode) send(st SendType,to *memberlist.Node, msg []byte) error {
 	switch st {
 	case ST_Datagram: return w.Membl.SendBestEffort(to,msg)
 	case ST_Reliable: return w.Membl.SendReliable(to,msg)
@@ -0,0 +1,321 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst
+
+import (
+	"github.com/hashicorp/memberlist"
+	"github.com/hashicorp/serf/coordinate"
+	"github.com/byte-mug/golibs/bufferex"
+	"github.com/vmihailenco/msgpack"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTimeout = errors.New("Timeout")
+)
+
+func init() {
+	RegisterSchema(MH_Ping,Schema{Name:"MH_Ping",Fields:[]string{"target","targid"}})
+	RegisterSchema(MH_Pong,Schema{Name:"MH_Pong",Fields:[]string{"targid","name"}})
+}
+
+/*
+Smoothing factor of the RTT average, if LatencyTable.Alpha is 0.
+*/
+const DefaultAlpha = 0.2
+
+/*
+Pings, that have not been answered within this time, are forgotten.
+*/
+const pingExpiry = time.Minute
+
+type Latency struct{
+	RTT     time.Duration // Exponentially weighted moving average.
+	Last    time.Time     // Time of the last sample.
+	Samples uint64
+}
+
+/*
+The LatencyTable records the round-trip times to other nodes. Samples are taken
+from application-level pings (see WrapNode.Ping) and from the probes of memberlist.
+
+Optionally, Vivaldi network coordinates can be enabled, in order to estimate the RTT
+to nodes, that have never been pinged directly.
+*/
+type LatencyTable struct{
+	Alpha float64
+	
+	lck    sync.RWMutex
+	peers  map[string]*Latency
+	client *coordinate.Client
+	coords map[string]*coordinate.Coordinate
+	
+	plck  sync.Mutex
+	pings map[uint64]pendingPing
+}
+
+/*
+A ping, that awaits its pong. The send time is kept locally, so the RTT is taken
+from the monotonic clock and can not be forged by the peer.
+*/
+type pendingPing struct{
+	to   string
+	sent time.Time
+}
+
+func (l *LatencyTable) sent(id uint64, to string) {
+	now := time.Now()
+	l.plck.Lock()
+	defer l.plck.Unlock()
+	if l.pings==nil { l.pings = make(map[uint64]pendingPing) }
+	for k,p := range l.pings {
+		if now.Sub(p.sent)>pingExpiry { delete(l.pings,k) }
+	}
+	l.pings[id] = pendingPing{to,now}
+}
+func (l *LatencyTable) answered(id uint64) (pendingPing,bool) {
+	l.plck.Lock()
+	defer l.plck.Unlock()
+	p,ok := l.pings[id]
+	if ok { delete(l.pings,id) }
+	return p,ok
+}
+
+/*
+Adds a RTT sample.
+*/
+func (l *LatencyTable) Add(name string, rtt time.Duration) {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+	if l.peers==nil { l.peers = make(map[string]*Latency) }
+	e := l.peers[name]
+	if e==nil {
+		e = &Latency{RTT:rtt}
+		l.peers[name] = e
+	} else {
+		a := l.Alpha
+		if a<=0 || a>1 { a = DefaultAlpha }
+		e.RTT = time.Duration(a*float64(rtt) + (1-a)*float64(e.RTT))
+	}
+	e.Last = time.Now()
+	e.Samples++
+}
+
+/*
+Returns the measured latency of a node.
+*/
+func (l *LatencyTable) Get(name string) (Latency,bool) {
+	l.lck.RLock()
+	defer l.lck.RUnlock()
+	e := l.peers[name]
+	if e==nil { return Latency{},false }
+	return *e,true
+}
+
+/*
+Returns the measured RTT to a node. If there is none, the RTT is estimated using
+the network coordinates, if they are enabled and known.
+*/
+func (l *LatencyTable) Estimate(name string) (time.Duration,bool) {
+	l.lck.RLock()
+	defer l.lck.RUnlock()
+	if e := l.peers[name]; e!=nil { return e.RTT,true }
+	if l.client==nil { return 0,false }
+	c := l.coords[name]
+	if c==nil { return 0,false }
+	return l.client.DistanceTo(c),true
+}
+
+/*
+Returns a copy of all measured latencies.
+*/
+func (l *LatencyTable) Snapshot() map[string]Latency {
+	l.lck.RLock()
+	defer l.lck.RUnlock()
+	m := make(map[string]Latency,len(l.peers))
+	for k,v := range l.peers { m[k] = *v }
+	return m
+}
+
+/*
+Removes all information about a node.
+*/
+func (l *LatencyTable) Forget(name string) {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+	delete(l.peers,name)
+	delete(l.coords,name)
+	if l.client!=nil { l.client.ForgetNode(name) }
+}
+
+/*
+Enables Vivaldi network coordinates. The coordinates are exchanged within the
+probe messages of memberlist. Must be called before the memberlist is created.
+*/
+func (l *LatencyTable) EnableCoordinates() error {
+	c,err := coordinate.NewClient(coordinate.DefaultConfig())
+	if err!=nil { return err }
+	l.lck.Lock()
+	defer l.lck.Unlock()
+	l.client = c
+	l.coords = make(map[string]*coordinate.Coordinate)
+	return nil
+}
+
+/*
+Returns our own coordinate or nil, if coordinates are disabled.
+*/
+func (l *LatencyTable) Coordinate() *coordinate.Coordinate {
+	l.lck.RLock()
+	defer l.lck.RUnlock()
+	if l.client==nil { return nil }
+	return l.client.GetCoordinate()
+}
+
+func (l *LatencyTable) ackPayload() []byte {
+	c := l.Coordinate()
+	if c==nil { return nil }
+	b,_ := msgpack.Marshal(c)
+	return b
+}
+
+func (l *LatencyTable) probed(name string, rtt time.Duration, payload []byte) {
+	l.Add(name,rtt)
+	if len(payload)==0 { return }
+	l.lck.Lock()
+	defer l.lck.Unlock()
+	if l.client==nil { return }
+	c := new(coordinate.Coordinate)
+	if msgpack.Unmarshal(payload,c)!=nil { return }
+	if _,err := l.client.Update(name,c,rtt); err!=nil { return }
+	l.coords[name] = c
+}
+
+/*
+memberlist.PingDelegate
+
+If the config already had a PingDelegate (see WrapNode.SetCfg), it is called as
+well. Its ack payload takes precedence, so coordinates are not exchanged then.
+*/
+func (i *InternalNode) AckPayload() []byte {
+	if i.ping!=nil { return i.ping.AckPayload() }
+	return i.lat.ackPayload()
+}
+func (i *InternalNode) NotifyPingComplete(other *memberlist.Node, rtt time.Duration, payload []byte) {
+	if i.ping!=nil {
+		i.ping.NotifyPingComplete(other,rtt,payload)
+		payload = nil
+	}
+	i.lat.probed(other.Name,rtt,payload)
+}
+
+var _ memberlist.PingDelegate = (*InternalNode)(nil)
+
+func (w *WrapNode) ping(to *memberlist.Node, id uint64) error {
+	mb := w.NewMessage()
+	mb.EncodeMulti(MH_Ping,w.Name,id)
+	w.Latency.sent(id,to.Name)
+	return w.SendTo(ST_Datagram,to,mb.Bytes())
+}
+
+/*
+Sends a ping. The RTT is recorded in w.Latency, once the pong arrives.
+*/
+func (w *WrapNode) Ping(to *memberlist.Node) error {
+	return w.ping(to,w.Calls.next())
+}
+
+/*
+Sends a ping and waits for the pong.
+*/
+func (w *WrapNode) PingWait(to *memberlist.Node, timeout time.Duration) (time.Duration,error) {
+	c := w.Calls.New(1)
+	defer c.Close()
+	start := time.Now()
+	if err := w.ping(to,c.ID); err!=nil { return 0,err }
+	rs := c.Wait(1,timeout)
+	if len(rs)==0 { return 0,ErrTimeout }
+	rs[0].Free()
+	return time.Since(start),nil
+}
+
+/*
+Pings all members every interval and forgets nodes, that are no longer members.
+Call the returned function to stop it.
+*/
+func (w *WrapNode) StartPinger(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var once sync.Once
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done: return
+			case <-t.C:
+			}
+			alive := make(map[string]bool)
+			for _,n := range w.Membl.Members() {
+				alive[n.Name] = true
+				if n.Name==w.Name { continue }
+				w.Ping(n)
+			}
+			for name := range w.Latency.Snapshot() {
+				if !alive[name] { w.Latency.Forget(name) }
+			}
+		}
+	}()
+	return func() { once.Do(func() { close(done) }) }
+}
+
+func pingHandler(w *WrapNode,d *MessageReader, msg bufferex.Binary) bool {
+	target,err := d.DecodeString()
+	if err!=nil { return false }
+	id,err := d.DecodeUint64()
+	if err!=nil { return false }
+	node := w.Lookup(target)
+	if node==nil { return false }
+	mb := w.NewMessage()
+	mb.EncodeMulti(MH_Pong,id,w.Name)
+	w.SendTo(ST_Datagram,node,mb.Bytes())
+	return false
+}
+
+func pongHandler(w *WrapNode,d *MessageReader, msg bufferex.Binary) bool {
+	id,err := d.DecodeUint64()
+	if err!=nil { return false }
+	
+	// Unsolicited or duplicate pongs are ignored.
+	p,ok := w.Latency.answered(id)
+	if !ok { return false }
+	rtt := time.Since(p.sent)
+	w.Latency.Add(p.to,rtt)
+	w.Relay.contact(p.to)
+	w.Metrics.Histogram("cherdy_ping_rtt_seconds","Round-trip times measured by MH_Ping.",nil).Observe(rtt.Seconds())
+	w.Calls.deliver(id,d,msg)
+	return false
+}
+
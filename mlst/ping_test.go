@@ -0,0 +1,76 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst_test
+
+import (
+	"github.com/byte-mug/cherdy/mlst"
+	"testing"
+	"time"
+)
+
+func TestLatencyTable(t *testing.T) {
+	l := mlst.LatencyTable{Alpha:0.5}
+	if _,ok := l.Estimate("a"); ok { t.Fatal("estimate for an unknown node") }
+	l.Add("a",time.Millisecond*100)
+	l.Add("a",time.Millisecond*200)
+	e,ok := l.Get("a")
+	if !ok || e.RTT!=time.Millisecond*150 || e.Samples!=2 { t.Fatalf("latency %+v",e) }
+	if rtt,ok := l.Estimate("a"); !ok || rtt!=e.RTT { t.Fatal("the estimate differs from the measurement") }
+	if len(l.Snapshot())!=1 { t.Fatal("snapshot") }
+	l.Forget("a")
+	if _,ok := l.Get("a"); ok { t.Fatal("the node has not been forgotten") }
+}
+
+func TestPing(t *testing.T) {
+	c := cluster(t,2,nil)
+	w := c.Nodes[0]
+	n1 := lookup(t,w,"node-1")
+	c.Net.SetLatency(time.Millisecond*20,0)
+	
+	rtt,err := w.PingWait(n1,time.Second)
+	if err!=nil { t.Fatal(err) }
+	if rtt<time.Millisecond*40 { t.Fatalf("rtt = %v on a link with 20ms latency",rtt) }
+	if e,ok := w.Latency.Get("node-1"); !ok || e.Samples==0 { t.Fatal("the rtt has not been recorded") }
+	
+	c.Net.Partition([]string{"node-0"},[]string{"node-1"})
+	if _,err = w.PingWait(n1,time.Millisecond*100); err!=mlst.ErrTimeout { t.Fatalf("ping across a partition: %v",err) }
+}
+
+func TestPinger(t *testing.T) {
+	c := cluster(t,3,nil)
+	w := c.Nodes[0]
+	w.Latency.Add("gone",time.Millisecond) // Not a member.
+	stop := w.StartPinger(time.Millisecond*20)
+	defer stop()
+	deadline := time.Now().Add(time.Second*2)
+	for {
+		s := w.Latency.Snapshot()
+		_,gone := s["gone"]
+		if !gone && s["node-1"].Samples>0 && s["node-2"].Samples>0 { break }
+		if time.Now().After(deadline) { t.Fatalf("latencies %v",s) }
+		time.Sleep(time.Millisecond*10)
+	}
+	stop()
+	stop()
+}
@@ -0,0 +1,115 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst
+
+import (
+	"github.com/byte-mug/golibs/bufferex"
+)
+
+/*
+Priority classes of the receive queue. Every class has its own queue.
+*/
+type Priority uint
+const (
+	PrioControl Priority = iota // Membership, routing and response messages.
+	PrioRequest // Default class.
+	PrioBulk // Bulk data transfers.
+	
+	NumPriorities
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PrioControl: return "control"
+	case PrioRequest: return "request"
+	case PrioBulk: return "bulk"
+	}
+	return "unknown"
+}
+
+/*
+Default number of messages, the consumer takes from each queue per round.
+*/
+var DefaultWeights = [NumPriorities]int{8,4,1}
+
+/*
+Returns the priority class of a message. It is chosen by the first header, that
+has a priority class. Envelope and routing headers without one (registered with
+Schema.Prefix) are skipped, so that routed messages are classified by the message
+they carry.
+*/
+func (i *InternalNode) classify(v bufferex.Binary) Priority {
+	dec := ReadMessage(v.Bytes())
+	for {
+		h,err := dec.DecodeUint64()
+		if err!=nil { return PrioRequest }
+		if p,ok := i.Prio[h]; ok {
+			if p>=NumPriorities { return PrioRequest }
+			return p
+		}
+		s := lookupSchema(h)
+		if s==nil || !s.Prefix { return PrioRequest }
+		for range s.Fields {
+			if dec.Skip()!=nil { return PrioRequest }
+		}
+	}
+}
+
+/*
+Sets the priority class for messages with the given header.
+Should be called before the memberlist is started.
+*/
+func (w *WrapNode) SetPriority(header uint64, p Priority) {
+	w.Deleg.Prio[header] = p
+}
+
+/*
+Weighted round-robin over the priority queues. In each round, up to Weights[p]
+messages are taken from queue p. If all queues are empty, it blocks until a
+message arrives.
+*/
+func (w *WrapNode) consumer() {
+	q := &w.Deleg.Queues
+	for {
+		n := 0
+		for p := range q {
+		inner:
+			for j := 0; j<w.Deleg.Weights[p]; j++ {
+				select {
+				case msg := <-q[p]:
+					w.consume(msg)
+					n++
+				default: break inner
+				}
+			}
+		}
+		if n!=0 { continue }
+		select {
+		case msg := <-q[PrioControl]: w.consume(msg)
+		case msg := <-q[PrioRequest]: w.consume(msg)
+		case msg := <-q[PrioBulk]: w.consume(msg)
+		}
+	}
+}
+
@@ -0,0 +1,72 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst_test
+
+import (
+	"github.com/byte-mug/cherdy/mlst"
+	"github.com/byte-mug/golibs/bufferex"
+	"testing"
+	"time"
+)
+
+/*
+Messages, that are already queued, when the consumer starts, are taken in weighted
+round-robin order. Routed messages are classified by the message they carry.
+*/
+func TestPriority(t *testing.T) {
+	w := new(mlst.WrapNode)
+	w.Initialize()
+	w.Name = "self"
+	w.StampOrigin = true
+	w.SetPriority(mhTest,mlst.PrioBulk)
+	w.SetPriority(mhOther,mlst.PrioControl)
+	got := make(chan string,32)
+	for _,h := range []uint64{mhTest,mhOther} {
+		w.Handlers[h] = func(w *mlst.WrapNode,d *mlst.MessageReader, msg bufferex.Binary) bool {
+			b,_ := d.DecodeBytes()
+			got <- string(b)
+			return false
+		}
+	}
+	for i := 0; i<10; i++ { w.Deleg.NotifyMsg(message(mhTest,"bulk")) }
+	for i := 0; i<10; i++ {
+		mb := w.NewMessage()
+		mb.EncodeMulti(mhOther,[]byte("control"))
+		w.Deleg.NotifyMsg(mb.Bytes())
+	}
+	w.PostStart()
+	
+	var order []string
+	for len(order)<20 {
+		select {
+		case s := <-got: order = append(order,s)
+		case <-time.After(time.Second): t.Fatalf("%d of 20 messages consumed",len(order))
+		}
+	}
+	// Round one: 8 control, 1 bulk. Round two: 2 control, 1 bulk. Then the rest.
+	want := "ccccccccbccbbbbbbbbb"
+	for i,s := range order {
+		if s[0]!=want[i] { t.Fatalf("message %d is %s, order %v",i,s,order) }
+	}
+}
@@ -0,0 +1,225 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst
+
+import (
+	"github.com/hashicorp/memberlist"
+	"github.com/byte-mug/golibs/bufferex"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoRelay = errors.New("No relay available")
+)
+
+func init() {
+	RegisterSchema(MH_Relay,Schema{Name:"MH_Relay",Fields:[]string{"dest","hops"},Prefix:true})
+}
+
+/*
+Relay configuration and the list of recent successful contacts.
+
+If enabled, SendTo falls back to sending the message through another member, if
+the destination can't be reached directly. The relay is chosen among the nodes,
+that have been contacted successfully within Window, preferring low RTTs.
+
+Relaying only helps, if the failure is detected. This is usually only the case for
+reliable transmission, as datagrams are fire-and-forget.
+*/
+type Relay struct{
+	Enabled bool
+	MaxHops int           // Maximum number of relays, a message may pass. Default: 2
+	Window  time.Duration // Default: one minute
+	Tries   int           // Number of relays to try. Default: 3
+	
+	// Messages of other nodes are forwarded by Workers goroutines (default: 4).
+	// If more than Queue messages (default: 64) are waiting, they are dropped.
+	Workers int
+	Queue   int
+	
+	lck      sync.Mutex
+	contacts map[string]time.Time
+	
+	once sync.Once
+	jobs chan relayJob
+}
+
+/*
+A message, that is forwarded on behalf of another node.
+*/
+type relayJob struct{
+	d     *MessageReader
+	msg   bufferex.Binary
+	node  *memberlist.Node
+	inner []byte
+	hops  int
+}
+
+func (r *Relay) maxHops() int {
+	if r.MaxHops<=0 { return 2 }
+	return r.MaxHops
+}
+func (r *Relay) window() time.Duration {
+	if r.Window<=0 { return time.Minute }
+	return r.Window
+}
+func (r *Relay) tries() int {
+	if r.Tries<=0 { return 3 }
+	return r.Tries
+}
+
+func (r *Relay) workers() int {
+	if r.Workers<=0 { return 4 }
+	return r.Workers
+}
+func (r *Relay) queue() int {
+	if r.Queue<=0 { return 64 }
+	return r.Queue
+}
+
+func (r *Relay) contact(name string) {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	if r.contacts==nil { r.contacts = make(map[string]time.Time) }
+	r.contacts[name] = time.Now()
+}
+
+/*
+Returns the names of the recently contacted nodes, that are not excluded.
+*/
+func (r *Relay) recent(exclude ...string) (names []string) {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	limit := time.Now().Add(-r.window())
+outer:
+	for name,t := range r.contacts {
+		if t.Before(limit) {
+			delete(r.contacts,name)
+			continue
+		}
+		for _,e := range exclude {
+			if e==name { continue outer }
+		}
+		names = append(names,name)
+	}
+	return
+}
+
+/*
+Sends msg to dest through a relay. hops is the number of further relays, the
+message may pass after the first one. The excluded nodes, e.g. the nodes, the
+message came from, are not used as relays.
+
+The wrapper always carries an MH_Origin header, so the relay knows, whom not to
+send the message back to.
+*/
+func (w *WrapNode) relay(st SendType,dest *memberlist.Node, msg []byte, hops int, exclude ...string) error {
+	if hops<0 { return ErrNoRelay }
+	cands := w.Relay.recent(append([]string{dest.Name,w.Name},exclude...)...)
+	
+	// Prefer fast relays. Unknown RTTs sort last.
+	rtt := make(map[string]time.Duration,len(cands))
+	for _,c := range cands {
+		d,ok := w.Latency.Estimate(c)
+		if !ok { d = time.Hour }
+		rtt[c] = d
+	}
+	sort.Slice(cands,func(i,j int) bool { return rtt[cands[i]]<rtt[cands[j]] })
+	
+	mb := new(MessageBuffer).Init()
+	mb.EncodeMulti(MH_Origin,w.Name,MH_Relay,dest.Name,hops)
+	mb.Write(msg)
+	wrapped := mb.Bytes()
+	st = w.sendType(st,len(wrapped))
+	
+	tries := w.Relay.tries()
+	for _,c := range cands {
+		if tries==0 { break }
+		node := w.Lookup(c)
+		if node==nil { continue }
+		tries--
+		if w.transmit(st,node,wrapped)==nil {
+			w.Log.Debug("message relayed","dest",dest.Name,"relay",c,"hops",hops)
+			w.Metrics.Counter("cherdy_relay_sent_total","Messages sent through a relay.").Inc()
+			return nil
+		}
+	}
+	w.Log.Debug("relay failed","dest",dest.Name,"candidates",len(cands))
+	return ErrNoRelay
+}
+
+func relayHandler(w *WrapNode,d *MessageReader, msg bufferex.Binary) bool {
+	dest,err := d.DecodeString()
+	if err!=nil { return false }
+	hops,err := d.DecodeInt()
+	if err!=nil { return false }
+	
+	// If this packet is for us, consume the rest of it.
+	if dest==w.Name { return true }
+	
+	if !w.Relay.Enabled {
+		w.Log.Debug("relay dropped","reason","disabled","dest",dest)
+		return false
+	}
+	node := w.Lookup(dest)
+	if node==nil {
+		w.Log.Debug("relay dropped","reason","unknown-node","dest",dest)
+		return false
+	}
+	
+	// The rest of the packet is the original message. Transmitting it may block,
+	// so it is done by the workers, not by the consumer.
+	w.Relay.once.Do(func() {
+		w.Relay.jobs = make(chan relayJob,w.Relay.queue())
+		for i := w.Relay.workers(); i>0; i-- { go w.relayWorker() }
+	})
+	RetainBinary(d)
+	select {
+	case w.Relay.jobs <- relayJob{d,msg,node,d.Bytes(),hops}:
+	default:
+		d.Release(msg)
+		w.Log.Debug("relay dropped","reason","queue-full","dest",dest)
+		w.Metrics.Counter(mDropped,mDroppedHelp,"reason","relay-queue-full").Inc()
+	}
+	return false
+}
+
+func (w *WrapNode) relayWorker() {
+	for j := range w.Relay.jobs {
+		st := w.sendType(ST_BestFit,len(j.inner))
+		if w.transmit(st,j.node,j.inner)==nil {
+			w.Relay.contact(j.node.Name)
+			w.Metrics.Counter("cherdy_relay_forwarded_total","Messages forwarded on behalf of other nodes.").Inc()
+		} else {
+			// Neither send it back to the previous hop, nor to the original sender.
+			_,org,_ := peekMessage(j.inner)
+			w.relay(ST_BestFit,j.node,j.inner,j.hops-1,j.d.Origin,org)
+		}
+		j.d.Release(j.msg)
+	}
+}
+
@@ -0,0 +1,101 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst_test
+
+import (
+	"errors"
+	"github.com/byte-mug/cherdy/mlst"
+	"github.com/hashicorp/memberlist"
+	"strings"
+	"testing"
+)
+
+var errUnreachable = errors.New("unreachable")
+
+/*
+Makes the named node unreachable from w. Everything else is sent.
+*/
+func cut(w *mlst.WrapNode, name string) {
+	w.SetInterceptor(func(st mlst.SendType,to *memberlist.Node, msg []byte, send mlst.SendFunc) error {
+		if to.Name==name { return errUnreachable }
+		return send(st,to,msg)
+	})
+}
+
+func TestRelay(t *testing.T) {
+	c := cluster(t,3,func(i int, wn *mlst.WrapNode, cfg *memberlist.Config) { wn.Relay.Enabled = true })
+	w := c.Nodes[0]
+	recv := count(c.Nodes[2],mhTest)
+	n1,n2 := lookup(t,w,"node-1"),lookup(t,w,"node-2")
+	
+	// Without a recent contact, there is no relay.
+	cut(w,"node-2")
+	if err := w.SendTo(mlst.ST_Reliable,n2,message(mhTest,"x")); err!=errUnreachable { t.Fatalf("send without relay candidates: %v",err) }
+	
+	if err := w.SendTo(mlst.ST_Reliable,n1,message(mhOther,"contact")); err!=nil { t.Fatal(err) }
+	if err := w.SendTo(mlst.ST_Reliable,n2,message(mhTest,"relayed")); err!=nil { t.Fatalf("send through a relay: %v",err) }
+	if recv.settle()!=1 || string(<-recv.ch)!="relayed" { t.Fatal("the relayed message did not arrive") }
+	
+	var sb strings.Builder
+	w.Metrics.WritePrometheus(&sb)
+	if !strings.Contains(sb.String(),"cherdy_relay_sent_total 1\n") { t.Error("relay_sent not counted") }
+	sb.Reset()
+	c.Nodes[1].Metrics.WritePrometheus(&sb)
+	if !strings.Contains(sb.String(),"cherdy_relay_forwarded_total 1\n") { t.Error("relay_forwarded not counted") }
+}
+
+/*
+A node, that has relaying disabled, does not forward messages of others.
+*/
+func TestRelayDisabled(t *testing.T) {
+	c := cluster(t,3,func(i int, wn *mlst.WrapNode, cfg *memberlist.Config) { wn.Relay.Enabled = i==0 })
+	w := c.Nodes[0]
+	recv := count(c.Nodes[2],mhTest)
+	cut(w,"node-2")
+	w.SendTo(mlst.ST_Reliable,lookup(t,w,"node-1"),message(mhOther,"contact"))
+	w.SendTo(mlst.ST_Reliable,lookup(t,w,"node-2"),message(mhTest,"x"))
+	if recv.settle()!=0 { t.Fatal("a disabled relay forwarded the message") }
+}
+
+/*
+A relay, that can't reach the destination either, does not send the message back to
+the node, it came from.
+*/
+func TestRelayNoBounce(t *testing.T) {
+	c := cluster(t,3,func(i int, wn *mlst.WrapNode, cfg *memberlist.Config) { wn.Relay.Enabled = true })
+	w,r := c.Nodes[0],c.Nodes[1]
+	recv := count(c.Nodes[2],mhTest)
+	cut(w,"node-2")
+	cut(r,"node-2")
+	
+	// Both know each other as recent contacts.
+	if err := r.SendTo(mlst.ST_Reliable,lookup(t,r,"node-0"),message(mhOther,"contact")); err!=nil { t.Fatal(err) }
+	if err := w.SendTo(mlst.ST_Reliable,lookup(t,w,"node-1"),message(mhOther,"contact")); err!=nil { t.Fatal(err) }
+	if err := w.SendTo(mlst.ST_Reliable,lookup(t,w,"node-2"),message(mhTest,"x")); err!=nil { t.Fatalf("send through a relay: %v",err) }
+	if recv.settle()!=0 { t.Fatal("the message passed a cut link") }
+	
+	var sb strings.Builder
+	r.Metrics.WritePrometheus(&sb)
+	if strings.Contains(sb.String(),"cherdy_relay_sent_total") { t.Error("the relay sent the message back") }
+}
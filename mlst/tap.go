@@ -0,0 +1,200 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst
+
+import (
+	"github.com/vmihailenco/msgpack"
+	"github.com/byte-mug/golibs/bufferex"
+	"bufio"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+/*
+Wire tap recordings.
+
+A recording is a sequence of MessagePack values. It starts with the string
+
+	"cherdy-tap/1"
+
+followed by any number of records. Every record consists of five values:
+
+	direction  uint   (0 = received, 1 = sent)
+	timestamp  int    (Unix time in nanoseconds)
+	peer       string (receiver of a sent message, sender of a received message or "")
+	header     uint   (first message header, that is not an envelope header)
+	data       bin    (the raw message, including envelope headers)
+
+The peer of a received message is only known, if it carries an MH_Origin header.
+Received messages are recorded on arrival, before they are queued, so messages,
+that are dropped later (full queue, rate limit) are part of the recording.
+*/
+const tapMagic = "cherdy-tap/1"
+
+var ErrNotARecording = errors.New("Not a wire tap recording")
+
+type Direction uint
+const (
+	DirRecv Direction = iota
+	DirSend
+)
+
+type Record struct{
+	Dir    Direction
+	Time   time.Time
+	Peer   string
+	Header uint64
+	Data   []byte
+}
+
+/*
+Writes a recording. It is installed using:
+
+	rec,err := mlst.NewRecorder(file)
+	wn.SetRecorder(rec)
+
+Errors, that occur while recording are sticky and reported by Flush() and Close().
+*/
+type Recorder struct{
+	lck sync.Mutex
+	buf *bufio.Writer
+	enc *msgpack.Encoder
+	dst io.Writer
+	err error
+}
+
+func NewRecorder(w io.Writer) (*Recorder,error) {
+	r := &Recorder{buf:bufio.NewWriter(w),dst:w}
+	r.enc = msgpack.NewEncoder(r.buf)
+	r.err = r.enc.EncodeString(tapMagic)
+	return r,r.err
+}
+
+func (r *Recorder) Record(dir Direction, peer string, msg []byte) {
+	h,_ := PeekHeader(msg)
+	now := time.Now()
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	if r.err!=nil { return }
+	r.err = r.enc.EncodeMulti(uint(dir),now.UnixNano(),peer,h,msg)
+}
+
+func (r *Recorder) Flush() error {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	if r.err!=nil { return r.err }
+	r.err = r.buf.Flush()
+	return r.err
+}
+
+/*
+Flushes the recording and closes the underlying writer, if it is an io.Closer.
+*/
+func (r *Recorder) Close() error {
+	err := r.Flush()
+	if c,ok := r.dst.(io.Closer); ok {
+		if e := c.Close(); err==nil { err = e }
+	}
+	return err
+}
+
+/*
+Sets the Recorder for all sent and received messages. It may be changed at any
+time. nil disables recording.
+*/
+func (w *WrapNode) SetRecorder(rec *Recorder) {
+	w.iclck.Lock()
+	defer w.iclck.Unlock()
+	w.rec = rec
+}
+func (w *WrapNode) recorder() *Recorder {
+	w.iclck.RLock()
+	defer w.iclck.RUnlock()
+	return w.rec
+}
+
+func (i *InternalNode) record(msg []byte) {
+	if i.tap==nil { return }
+	if rec := i.tap(); rec!=nil {
+		_,org,_ := peekMessage(msg)
+		rec.Record(DirRecv,org,msg)
+	}
+}
+
+/*
+Reads a recording.
+*/
+type TapReader struct{
+	dec *msgpack.Decoder
+}
+
+func NewTapReader(r io.Reader) (*TapReader,error) {
+	t := &TapReader{msgpack.NewDecoder(bufio.NewReader(r))}
+	s,err := t.dec.DecodeString()
+	if err!=nil || s!=tapMagic { return nil,ErrNotARecording }
+	return t,nil
+}
+
+/*
+Returns the next record or io.EOF at the end of the recording.
+*/
+func (t *TapReader) Next() (*Record,error) {
+	var dir uint
+	var ts int64
+	rec := new(Record)
+	err := t.dec.DecodeMulti(&dir,&ts,&rec.Peer,&rec.Header,&rec.Data)
+	if err!=nil { return nil,err }
+	rec.Dir = Direction(dir)
+	rec.Time = time.Unix(0,ts)
+	return rec,nil
+}
+
+/*
+Feeds all received messages of a recording into the handlers of w, in order to
+reproduce a bug. Sent messages are skipped.
+
+If speed is 0, the messages are replayed as fast as possible. Otherwise the
+original timing is reproduced, scaled by speed (2 = twice as fast).
+*/
+func (w *WrapNode) Replay(t *TapReader, speed float64) error {
+	var first,start time.Time
+	for {
+		rec,err := t.Next()
+		if err==io.EOF { return nil }
+		if err!=nil { return err }
+		if rec.Dir!=DirRecv { continue }
+		if speed>0 {
+			if first.IsZero() {
+				first,start = rec.Time,time.Now()
+			} else {
+				due := start.Add(time.Duration(float64(rec.Time.Sub(first))/speed))
+				time.Sleep(time.Until(due))
+			}
+		}
+		w.consume(bufferex.NewBinary(rec.Data))
+	}
+}
+
@@ -0,0 +1,84 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst_test
+
+import (
+	"bytes"
+	"github.com/byte-mug/cherdy/mlst"
+	"github.com/hashicorp/memberlist"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestTapRecordReplay(t *testing.T) {
+	c := cluster(t,2,func(i int, wn *mlst.WrapNode, cfg *memberlist.Config) { wn.StampOrigin = true })
+	w := c.Nodes[0]
+	recv := count(w,mhTest)
+	var buf bytes.Buffer
+	rec,err := mlst.NewRecorder(&buf)
+	if err!=nil { t.Fatal(err) }
+	w.SetRecorder(rec)
+	
+	n0 := lookup(t,c.Nodes[1],"node-0")
+	for _,s := range []string{"a","b","c"} {
+		c.Nodes[1].SendTo(mlst.ST_Reliable,n0,message(mhTest,s))
+	}
+	w.SendTo(mlst.ST_Reliable,lookup(t,w,"node-1"),message(mhOther,"d"))
+	if n := recv.settle(); n!=3 { t.Fatalf("%d messages received",n) }
+	w.SetRecorder(nil)
+	if err = rec.Flush(); err!=nil { t.Fatal(err) }
+	
+	tr,err := mlst.NewTapReader(bytes.NewReader(buf.Bytes()))
+	if err!=nil { t.Fatal(err) }
+	var got []string
+	for {
+		r,err := tr.Next()
+		if err==io.EOF { break }
+		if err!=nil { t.Fatal(err) }
+		got = append(got,r.String())
+		switch {
+		case r.Dir==mlst.DirRecv && (r.Header!=mhTest || r.Peer!="node-1"): t.Fatalf("received record %v",r)
+		case r.Dir==mlst.DirSend && (r.Header!=mhOther || r.Peer!="node-1"): t.Fatalf("sent record %v",r)
+		}
+	}
+	if len(got)!=4 { t.Fatalf("%d records: %v",len(got),got) }
+	
+	// Replay the received messages into a fresh node.
+	x := new(mlst.WrapNode)
+	x.Initialize()
+	replayed := count(x,mhTest)
+	tr,_ = mlst.NewTapReader(bytes.NewReader(buf.Bytes()))
+	start := time.Now()
+	if err = x.Replay(tr,0); err!=nil { t.Fatal(err) }
+	if time.Since(start)>time.Millisecond*100 { t.Fatal("replay at speed 0 is slow") }
+	if replayed.value()!=3 { t.Fatalf("%d messages replayed",replayed.value()) }
+	for _,s := range []string{"a","b","c"} {
+		if m := string(<-replayed.ch); m!=s { t.Fatalf("replayed %q, want %q",m,s) }
+	}
+}
+
+func TestTapReaderRejects(t *testing.T) {
+	if _,err := mlst.NewTapReader(bytes.NewReader(message(mhTest,"x"))); err!=mlst.ErrNotARecording { t.Fatalf("err = %v",err) }
+}
@@ -0,0 +1,189 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst
+
+import (
+	"github.com/byte-mug/golibs/bufferex"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+type TraceID [16]byte
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (t TraceID) IsZero() bool { return t==TraceID{} }
+
+/*
+A Span records the execution of an operation on one node.
+*/
+type Span struct{
+	Trace  TraceID
+	ID     uint64
+	Parent uint64 // 0 for the root span.
+	Name   string
+	Node   string
+	Start  time.Time
+	End    time.Time
+	Attrs  map[string]interface{}
+	
+	tracer *Tracer
+}
+
+func (s *Span) SetAttr(k string, v interface{}) {
+	if s.Attrs==nil { s.Attrs = make(map[string]interface{}) }
+	s.Attrs[k] = v
+}
+
+/*
+Ends the span and hands it over to the exporter. A nil span is ignored.
+*/
+func (s *Span) Finish() {
+	if s==nil { return }
+	s.End = time.Now()
+	if s.tracer.Exporter!=nil { s.tracer.Exporter.Export(s) }
+}
+
+type SpanExporter interface{
+	Export(s *Span)
+}
+
+/*
+The Tracer creates spans. Trace contexts are always propagated, spans are only
+recorded, if an Exporter is set.
+*/
+type Tracer struct{
+	Exporter SpanExporter
+	
+	node string
+}
+
+func spanID() uint64 {
+	var b [8]byte
+	for {
+		rand.Read(b[:])
+		if id := binary.BigEndian.Uint64(b[:]); id!=0 { return id }
+	}
+}
+
+/*
+Starts a new trace.
+*/
+func (t *Tracer) Root(name string) *Span {
+	s := &Span{ID:spanID(),Name:name,Node:t.node,Start:time.Now(),tracer:t}
+	rand.Read(s.Trace[:])
+	return s
+}
+
+/*
+Starts a span as child of the current span of the message and makes it the
+current span. Returns nil, if the message is not traced.
+*/
+func (t *Tracer) Start(d *MessageReader, name string) *Span {
+	if d.trace.IsZero() { return nil }
+	s := &Span{Trace:d.trace,ID:spanID(),Parent:d.span,Name:name,Node:t.node,Start:time.Now(),tracer:t}
+	d.span = s.ID
+	return s
+}
+
+func traceHeader(w *WrapNode,d *MessageReader, msg bufferex.Binary) bool {
+	tid,err := d.DecodeBytes()
+	if err!=nil { return false }
+	parent,err := d.DecodeUint64()
+	if err!=nil { return false }
+	copy(d.trace[:],tid)
+	d.span = parent
+	return true
+}
+
+/*
+Writes the trace context of span s, so the receiver continues the trace.
+Must be called before the message header is written. A nil span is ignored.
+*/
+func (m *MessageBuffer) EncodeSpan(s *Span) {
+	if s==nil { return }
+	m.EncodeMulti(MH_Trace,s.Trace[:],s.ID)
+}
+
+/*
+Writes spans as JSON, one object per line:
+
+	{"trace":"…","span":"…","parent":"…","name":"MH_Get","node":"node-1","start":"…","duration_ns":1234,"attrs":{…}}
+*/
+type JSONExporter struct{
+	lck sync.Mutex
+	enc *json.Encoder
+	dst io.Writer
+}
+
+func NewJSONExporter(w io.Writer) *JSONExporter {
+	return &JSONExporter{enc:json.NewEncoder(w),dst:w}
+}
+
+type jsonSpan struct{
+	Trace    string                 `json:"trace"`
+	Span     string                 `json:"span"`
+	Parent   string                 `json:"parent,omitempty"`
+	Name     string                 `json:"name"`
+	Node     string                 `json:"node"`
+	Start    time.Time              `json:"start"`
+	Duration int64                  `json:"duration_ns"`
+	Attrs    map[string]interface{} `json:"attrs,omitempty"`
+}
+
+func hexID(id uint64) string {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:],id)
+	return hex.EncodeToString(b[:])
+}
+
+func (j *JSONExporter) Export(s *Span) {
+	js := jsonSpan{
+		Trace: s.Trace.String(),
+		Span: hexID(s.ID),
+		Name: s.Name,
+		Node: s.Node,
+		Start: s.Start,
+		Duration: int64(s.End.Sub(s.Start)),
+		Attrs: s.Attrs,
+	}
+	if s.Parent!=0 { js.Parent = hexID(s.Parent) }
+	j.lck.Lock()
+	defer j.lck.Unlock()
+	j.enc.Encode(js)
+}
+
+/*
+Closes the underlying writer, if it is an io.Closer.
+*/
+func (j *JSONExporter) Close() error {
+	j.lck.Lock()
+	defer j.lck.Unlock()
+	if c,ok := j.dst.(io.Closer); ok { return c.Close() }
+	return nil
+}
+
@@ -0,0 +1,109 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package mlst_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/byte-mug/cherdy/mlst"
+	"github.com/byte-mug/golibs/bufferex"
+	"github.com/hashicorp/memberlist"
+	"testing"
+	"time"
+)
+
+type chanExporter chan *mlst.Span
+func (c chanExporter) Export(s *mlst.Span) { c <- s }
+
+func (c chanExporter) next(t *testing.T) *mlst.Span {
+	select {
+	case s := <-c: return s
+	case <-time.After(time.Second): t.Fatal("no span exported")
+	}
+	return nil
+}
+
+/*
+node-0 starts a trace and sends a request to node-1, which forwards it to node-2.
+*/
+func TestTracePropagation(t *testing.T) {
+	spans := make(chanExporter,16)
+	c := cluster(t,3,func(i int, wn *mlst.WrapNode, cfg *memberlist.Config) {
+		wn.Tracer.Exporter = spans
+	})
+	c.Nodes[1].Handlers[mhDescribed] = func(w *mlst.WrapNode,d *mlst.MessageReader, msg bufferex.Binary) bool {
+		mb := new(mlst.MessageBuffer).Init()
+		mb.EncodeEnvelope(d)
+		mb.EncodeMulti(mhOther,[]byte("forwarded"))
+		w.SendTo(mlst.ST_Reliable,w.Lookup("node-2"),mb.Bytes())
+		return false
+	}
+	fwd := count(c.Nodes[2],mhOther)
+	
+	w := c.Nodes[0]
+	root := w.Tracer.Root("request")
+	mb := new(mlst.MessageBuffer).Init()
+	mb.EncodeSpan(root)
+	mb.EncodeMulti(mhDescribed,[]byte("k"),1)
+	w.SendTo(mlst.ST_Reliable,lookup(t,w,"node-1"),mb.Bytes())
+	root.Finish()
+	
+	got := map[string]*mlst.Span{}
+	for i := 0; i<3; i++ {
+		s := spans.next(t)
+		got[s.Node] = s
+	}
+	if fwd.value()!=1 { t.Fatal("not forwarded") }
+	s0,s1,s2 := got["node-0"],got["node-1"],got["node-2"]
+	if s0==nil || s1==nil || s2==nil { t.Fatalf("spans %v",got) }
+	if s0!=root || s0.Parent!=0 { t.Fatal("the root span is wrong") }
+	if s1.Trace!=root.Trace || s2.Trace!=root.Trace { t.Fatal("the trace id is not propagated") }
+	if s1.Parent!=root.ID || s2.Parent!=s1.ID { t.Fatalf("parents %x %x, want %x %x",s1.Parent,s2.Parent,root.ID,s1.ID) }
+	if s1.Name!="MH_Described" || s1.Attrs["origin"]==nil { t.Fatalf("span %+v",s1) }
+	if s1.End.Before(s1.Start) { t.Fatal("span ends before it starts") }
+	
+	// Untraced messages are not recorded.
+	c.Nodes[1].SendTo(mlst.ST_Reliable,lookup(t,c.Nodes[1],"node-2"),message(mhOther,"x"))
+	fwd.settle()
+	select {
+	case s := <-spans: t.Fatalf("span for an untraced message: %+v",s)
+	default:
+	}
+}
+
+func TestJSONExporter(t *testing.T) {
+	var buf bytes.Buffer
+	tr := &mlst.Tracer{Exporter:mlst.NewJSONExporter(&buf)}
+	s := tr.Root("job")
+	s.Parent = 0x0102
+	s.SetAttr("key","value")
+	s.Finish()
+	var js map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(),&js); err!=nil { t.Fatal(err) }
+	if js["trace"]!=s.Trace.String() || js["parent"]!="0000000000000102" || js["name"]!="job" { t.Fatalf("exported %s",buf.String()) }
+	if js["attrs"].(map[string]interface{})["key"]!="value" { t.Fatalf("exported %s",buf.String()) }
+	
+	var nilSpan *mlst.Span
+	nilSpan.Finish()
+}
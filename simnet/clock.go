@@ -0,0 +1,211 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package simnet
+
+import (
+	"container/heap"
+	"time"
+)
+
+/*
+A packet on it's way.
+*/
+type event struct{
+	due  time.Duration // Virtual time.
+	seq  uint64
+	dest *Transport
+	buf  []byte
+	from Addr
+}
+
+/*
+The packets in flight, ordered by due time and sequence number.
+*/
+type eventQueue struct{
+	evs []*event
+	seq uint64
+}
+
+func (q *eventQueue) Len() int { return len(q.evs) }
+func (q *eventQueue) Less(i, j int) bool {
+	a,b := q.evs[i],q.evs[j]
+	if a.due!=b.due { return a.due<b.due }
+	return a.seq<b.seq
+}
+func (q *eventQueue) Swap(i, j int) { q.evs[i],q.evs[j] = q.evs[j],q.evs[i] }
+func (q *eventQueue) Push(x interface{}) { q.evs = append(q.evs,x.(*event)) }
+func (q *eventQueue) Pop() interface{} {
+	l := len(q.evs)-1
+	e := q.evs[l]
+	q.evs[l] = nil
+	q.evs = q.evs[:l]
+	return e
+}
+
+/*
+Returns the virtual time. Must be called with the lock held.
+*/
+func (n *Network) now() time.Duration {
+	if n.manual { return n.clock }
+	return n.clock+time.Since(n.synced)
+}
+
+/*
+Returns the virtual time. It starts at 0, when the network is created, and follows
+the wall clock, unless the network is in manual mode.
+*/
+func (n *Network) Now() time.Duration {
+	n.lck.Lock()
+	defer n.lck.Unlock()
+	return n.now()
+}
+
+func (n *Network) isManual() bool {
+	n.lck.Lock()
+	defer n.lck.Unlock()
+	return n.manual
+}
+
+func (n *Network) wake() {
+	select {
+	case n.kick <- struct{}{}:
+	default:
+	}
+}
+
+/*
+Queues a packet for dest. It is due after delay.
+*/
+func (n *Network) send(dest *Transport, buf []byte, from Addr, delay time.Duration) {
+	n.lck.Lock()
+	n.queue.seq++
+	heap.Push(&n.queue,&event{n.now()+delay,n.queue.seq,dest,buf,from})
+	n.startDispatch()
+	n.lck.Unlock()
+	n.wake()
+}
+
+/*
+Starts the dispatcher, unless it runs already or the network is in manual mode.
+Must be called with the lock held.
+*/
+func (n *Network) startDispatch() {
+	if n.manual || n.running { return }
+	n.running = true
+	go n.dispatch()
+}
+
+/*
+Delivers the packets, as they become due. It exits, once the queue is empty or the
+network is switched into manual mode.
+*/
+func (n *Network) dispatch() {
+	for {
+		n.lck.Lock()
+		if n.manual || n.queue.Len()==0 {
+			n.running = false
+			n.lck.Unlock()
+			return
+		}
+		wait := n.queue.evs[0].due-n.now()
+		var e *event
+		if wait<=0 { e = heap.Pop(&n.queue).(*event) }
+		n.lck.Unlock()
+		
+		if e!=nil {
+			e.dest.deliver(e.buf,e.from)
+			continue
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-n.kick: // An earlier packet or a mode change.
+		}
+		t.Stop()
+	}
+}
+
+/*
+Switches between manual and automatic delivery. In manual mode, the virtual clock
+stands still and packets are only delivered by Step and Advance. Switching back
+delivers the packets, that are overdue, at once.
+*/
+func (n *Network) SetManual(on bool) {
+	n.lck.Lock()
+	if on!=n.manual {
+		n.clock,n.synced = n.now(),time.Now()
+		n.manual = on
+	}
+	if !on && n.queue.Len()>0 { n.startDispatch() }
+	n.lck.Unlock()
+	n.wake()
+}
+
+/*
+Returns the number of packets in flight.
+*/
+func (n *Network) Pending() int {
+	n.lck.Lock()
+	defer n.lck.Unlock()
+	return n.queue.Len()
+}
+
+/*
+Delivers the next packet in flight. In manual mode, the clock is advanced to the time,
+it is due. Returns false, if no packet is in flight.
+*/
+func (n *Network) Step() bool {
+	n.lck.Lock()
+	if n.queue.Len()==0 {
+		n.lck.Unlock()
+		return false
+	}
+	e := heap.Pop(&n.queue).(*event)
+	if n.manual && e.due>n.clock { n.clock = e.due }
+	n.lck.Unlock()
+	e.dest.deliver(e.buf,e.from)
+	return true
+}
+
+/*
+Advances the clock of a network in manual mode by d and delivers all packets, that
+are due until then, in order. Returns the number of delivered packets. In automatic
+mode, it does nothing.
+*/
+func (n *Network) Advance(d time.Duration) (count int) {
+	n.lck.Lock()
+	defer n.lck.Unlock()
+	if !n.manual { return 0 }
+	end := n.clock+d
+	for n.queue.Len()>0 && n.queue.evs[0].due<=end {
+		e := heap.Pop(&n.queue).(*event)
+		if e.due>n.clock { n.clock = e.due }
+		n.lck.Unlock()
+		e.dest.deliver(e.buf,e.from)
+		count++
+		n.lck.Lock()
+	}
+	n.clock = end
+	return
+}
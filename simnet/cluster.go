@@ -0,0 +1,163 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package simnet
+
+import (
+	"github.com/byte-mug/cherdy/mlst"
+	"github.com/hashicorp/memberlist"
+	"io/ioutil"
+	"time"
+	"fmt"
+)
+
+/*
+Called for every node before it is started. The setup function may attach plugins
+to the WrapNode and modify the memberlist config.
+*/
+type Setup func(i int, wn *mlst.WrapNode, cfg *memberlist.Config)
+
+/*
+A Cluster of WrapNodes, that are connected by a simulated Network.
+*/
+type Cluster struct{
+	Net   *Network
+	Nodes []*mlst.WrapNode
+	Lists []*memberlist.Memberlist
+	Trans []*Transport
+}
+
+/*
+Creates a cluster with n nodes (named "node-0" to "node-<n-1>"), starts them
+and lets them join node-0, one after another.
+
+Use WaitMembers to wait, until the cluster has converged.
+*/
+func NewCluster(nw *Network, n int, setup Setup) (*Cluster,error) {
+	c := &Cluster{Net:nw}
+	for i := 0; i<n; i++ {
+		if err := c.add(setup); err!=nil {
+			c.Shutdown()
+			return nil,err
+		}
+	}
+	if n<2 { return c,nil }
+	seed := []string{c.Trans[0].Addr()}
+	for i,ml := range c.Lists[1:] {
+		if _,err := ml.Join(seed); err!=nil {
+			c.Shutdown()
+			return nil,err
+		}
+		/*
+		The seed answers a push-pull with its state before it has merged the
+		previous joiner. Wait, until the seed knows this node, so that no member
+		stays invisible until the next periodic push-pull.
+		*/
+		if err := c.waitSeed(i+2,time.Second*5); err!=nil {
+			c.Shutdown()
+			return nil,err
+		}
+	}
+	return c,nil
+}
+
+func (c *Cluster) waitSeed(n int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for c.Lists[0].NumMembers()<n {
+		if time.Now().After(deadline) { return fmt.Errorf("node-0 did not see %d members within %v",n,timeout) }
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
+func (c *Cluster) add(setup Setup) error {
+	i := len(c.Nodes)
+	cfg := memberlist.DefaultLocalConfig()
+	cfg.Name = fmt.Sprintf("node-%d",i)
+	cfg.LogOutput = ioutil.Discard
+	
+	// Gossip retransmits each update only a few times in small clusters. A short
+	// push-pull interval repairs a missed update, before WaitMembers gives up.
+	cfg.PushPullInterval = time.Second
+	
+	t := c.Net.NewTransport(cfg.Name)
+	cfg.Transport = t
+	
+	wn := new(mlst.WrapNode)
+	wn.Initialize()
+	wn.SetCfg(cfg)
+	
+	if setup!=nil { setup(i,wn,cfg) }
+	
+	wn.PreStart()
+	ml,err := memberlist.Create(cfg)
+	if err!=nil { return err }
+	wn.Membl = ml
+	wn.PostStart()
+	
+	c.Nodes = append(c.Nodes,wn)
+	c.Lists = append(c.Lists,ml)
+	c.Trans = append(c.Trans,t)
+	return nil
+}
+
+/*
+Waits, until every running node sees exactly n alive members.
+*/
+func (c *Cluster) WaitMembers(n int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		ok := true
+		for i,ml := range c.Lists {
+			if c.Trans[i].isShutdown() { continue }
+			if ml.NumMembers()!=n { ok = false; break }
+		}
+		if ok { return nil }
+		if time.Now().After(deadline) { return fmt.Errorf("cluster did not converge to %d members within %v",n,timeout) }
+		time.Sleep(time.Millisecond*10)
+	}
+}
+
+/*
+Kills node i without a graceful leave. The other nodes will detect its death
+through the failure detector.
+*/
+func (c *Cluster) Kill(i int) error {
+	return c.Lists[i].Shutdown()
+}
+
+/*
+Gracefully removes node i from the cluster and shuts it down.
+*/
+func (c *Cluster) Leave(i int, timeout time.Duration) error {
+	if err := c.Lists[i].Leave(timeout); err!=nil { return err }
+	return c.Lists[i].Shutdown()
+}
+
+/*
+Shuts down all nodes.
+*/
+func (c *Cluster) Shutdown() {
+	for _,ml := range c.Lists { ml.Shutdown() }
+}
+
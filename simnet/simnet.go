@@ -0,0 +1,311 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+/*
+An in-process network, that implements memberlist.Transport.
+
+It allows to run several memberlist instances (or WrapNodes) within one process,
+with controllable latency, packet loss and network partitions.
+
+Packets travel through an event queue, that is ordered by the virtual time, they
+are due, and the order, they were sent in. By default, a dispatcher delivers them,
+as the virtual clock follows the wall clock. In manual mode (see SetManual), the
+clock stands still and the test delivers packets with Step and Advance. All random
+decisions are taken from one random source per link, derived from the seed and the
+names of both ends, so they don't depend on the traffic of other links.
+
+Memberlist itself uses the wall clock and it's own goroutines. A test, that needs an
+exact order of events, switches to manual mode, once the cluster has converged.
+*/
+package simnet
+
+import (
+	"github.com/hashicorp/memberlist"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+	"fmt"
+	"errors"
+)
+
+var (
+	ErrNoRoute = errors.New("No route to host")
+	ErrShutdown = errors.New("Transport is shut down")
+)
+
+type Addr string
+func (a Addr) Network() string { return "simnet" }
+func (a Addr) String() string { return string(a) }
+
+/*
+A simulated network. The zero value is not usable, use NewNetwork().
+
+All settings may be changed at any time.
+*/
+type Network struct{
+	lck  sync.Mutex
+	seed int64
+	rnds map[[2]string]*rand.Rand // One random source per link.
+	
+	latency, jitter time.Duration
+	loss float64
+	
+	byAddr map[string]*Transport
+	byName map[string]*Transport
+	group  map[string]int
+	port   int
+	
+	streams map[*stream]bool // Open stream connections.
+	
+	queue   eventQueue
+	clock   time.Duration // The virtual time at synced.
+	synced  time.Time
+	manual  bool
+	kick    chan struct{}
+	running bool // The dispatcher runs.
+}
+
+/*
+Creates a new network. All random decisions (packet loss, jitter) are derived
+from seed, so runs with the same seed and the same traffic are reproducible.
+*/
+func NewNetwork(seed int64) *Network {
+	n := &Network{
+		seed: seed,
+		rnds: make(map[[2]string]*rand.Rand),
+		byAddr: make(map[string]*Transport),
+		byName: make(map[string]*Transport),
+		group: make(map[string]int),
+		streams: make(map[*stream]bool),
+		synced: time.Now(),
+		kick: make(chan struct{},1),
+	}
+	return n
+}
+
+/*
+Returns the random source of the link between from and to. Must be called with the
+lock held.
+*/
+func (n *Network) rnd(from, to string) *rand.Rand {
+	k := [2]string{from,to}
+	r := n.rnds[k]
+	if r==nil {
+		h := fnv.New64a()
+		fmt.Fprintf(h,"%d\x00%s\x00%s",n.seed,from,to)
+		r = rand.New(rand.NewSource(int64(h.Sum64())))
+		n.rnds[k] = r
+	}
+	return r
+}
+
+/*
+Sets the one-way latency of every packet and stream connection. Each packet is
+delayed by latency plus a random value between 0 and jitter.
+*/
+func (n *Network) SetLatency(latency, jitter time.Duration) {
+	n.lck.Lock()
+	defer n.lck.Unlock()
+	n.latency,n.jitter = latency,jitter
+}
+
+/*
+Sets the probability (0.0 - 1.0) that a packet is lost. Stream connections are
+reliable and never lose data.
+*/
+func (n *Network) SetLoss(p float64) {
+	n.lck.Lock()
+	defer n.lck.Unlock()
+	n.loss = p
+}
+
+/*
+Splits the network into partitions. Every list of node names forms a partition.
+Nodes, that are not mentioned, remain in the default partition. Nodes in different
+partitions can't reach each other. Open stream connections between them are closed.
+*/
+func (n *Network) Partition(parts ...[]string) {
+	n.lck.Lock()
+	n.group = make(map[string]int)
+	for i,part := range parts {
+		for _,name := range part { n.group[name] = i+1 }
+	}
+	var cut []*stream
+	for st := range n.streams {
+		if n.group[st.a]!=n.group[st.b] { cut = append(cut,st) }
+	}
+	n.lck.Unlock()
+	
+	// Closing a stream takes the lock.
+	for _,st := range cut { st.close() }
+}
+
+/*
+Removes all partitions.
+*/
+func (n *Network) Heal() {
+	n.Partition()
+}
+
+/*
+Creates a new Transport for the node with the given name. Every transport has an
+address on a host of it's own, so limits per remote host apply per node.
+*/
+func (n *Network) NewTransport(name string) *Transport {
+	n.lck.Lock()
+	defer n.lck.Unlock()
+	n.port++
+	t := &Transport{
+		net: n,
+		name: name,
+		addr: Addr(fmt.Sprintf("10.%d.%d.%d:7946",n.port>>16&255,n.port>>8&255,n.port&255)),
+		packetCh: make(chan *memberlist.Packet,1024),
+		streamCh: make(chan net.Conn,16),
+		done: make(chan struct{}),
+	}
+	n.byAddr[string(t.addr)] = t
+	n.byName[name] = t
+	return t
+}
+
+/*
+Looks up the destination and decides, how the message should be delivered.
+*/
+func (n *Network) route(from *Transport, addr string, packet bool) (dest *Transport, delay time.Duration, drop bool, err error) {
+	n.lck.Lock()
+	defer n.lck.Unlock()
+	dest = n.byAddr[addr]
+	if dest==nil { return nil,0,false,ErrNoRoute }
+	if n.group[from.name]!=n.group[dest.name] {
+		// A partition behaves like a black hole, not like a rejecting host.
+		return dest,0,true,nil
+	}
+	rnd := n.rnd(from.name,dest.name)
+	delay = n.latency
+	if n.jitter>0 { delay += time.Duration(rnd.Int63n(int64(n.jitter))) }
+	if packet && n.loss>0 { drop = rnd.Float64()<n.loss }
+	return
+}
+
+/*
+A Transport, that is connected to a simulated Network.
+*/
+type Transport struct{
+	net  *Network
+	name string
+	addr Addr
+	
+	packetCh chan *memberlist.Packet
+	streamCh chan net.Conn
+	
+	once sync.Once
+	done chan struct{}
+}
+
+var _ memberlist.Transport = (*Transport)(nil)
+
+func (t *Transport) Name() string { return t.name }
+func (t *Transport) Addr() string { return string(t.addr) }
+
+func (t *Transport) isShutdown() bool {
+	select {
+	case <-t.done: return true
+	default: return false
+	}
+}
+
+func (t *Transport) FinalAdvertiseAddr(string, int) (net.IP, int, error) {
+	host,port,err := net.SplitHostPort(string(t.addr))
+	if err!=nil { return nil,0,err }
+	var p int
+	_,err = fmt.Sscan(port,&p)
+	if err!=nil { return nil,0,err }
+	return net.ParseIP(host),p,nil
+}
+
+func (t *Transport) WriteTo(b []byte, addr string) (time.Time, error) {
+	now := time.Now()
+	if t.isShutdown() { return now,ErrShutdown }
+	dest,delay,drop,err := t.net.route(t,addr,true)
+	if err!=nil { return now,err }
+	if drop { return now,nil }
+	
+	buf := make([]byte,len(b))
+	copy(buf,b)
+	t.net.send(dest,buf,t.addr,delay)
+	return now,nil
+}
+func (t *Transport) deliver(b []byte, from Addr) {
+	p := &memberlist.Packet{Buf:b,From:from,Timestamp:time.Now()}
+	select {
+	case <-t.done:
+	case t.packetCh <- p:
+	default: // Receive buffer overflow: drop the packet, like a real socket.
+	}
+}
+
+func (t *Transport) PacketCh() <-chan *memberlist.Packet { return t.packetCh }
+
+/*
+Opens a stream connection. Streams are reliable and not queued: in manual mode,
+they connect without delay.
+*/
+func (t *Transport) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	if t.isShutdown() { return nil,ErrShutdown }
+	dest,delay,drop,err := t.net.route(t,addr,false)
+	if err!=nil { return nil,err }
+	if drop || dest.isShutdown() {
+		time.Sleep(timeout)
+		return nil,fmt.Errorf("dial %s: i/o timeout",addr)
+	}
+	if t.net.isManual() { delay = 0 }
+	if delay>timeout {
+		time.Sleep(timeout)
+		return nil,fmt.Errorf("dial %s: i/o timeout",addr)
+	}
+	time.Sleep(delay)
+	
+	st := t.net.newStream(t,dest)
+	select {
+	case <-dest.done:
+	case dest.streamCh <- st.accept:
+		return st.dial,nil
+	case <-time.After(timeout-delay):
+	}
+	st.close()
+	return nil,fmt.Errorf("dial %s: connection refused",addr)
+}
+
+func (t *Transport) StreamCh() <-chan net.Conn { return t.streamCh }
+
+/*
+Shuts the transport down. Packets sent to it afterwards are silently lost and
+connection attempts time out, as if the host has crashed.
+*/
+func (t *Transport) Shutdown() error {
+	t.once.Do(func() { close(t.done) })
+	return nil
+}
+
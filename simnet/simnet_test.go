@@ -0,0 +1,162 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package simnet
+
+import (
+	"github.com/byte-mug/cherdy/mlst"
+	"github.com/hashicorp/memberlist"
+	"testing"
+	"time"
+)
+
+func drain(t *Transport) (bufs []string) {
+	for {
+		select {
+		case p := <-t.PacketCh(): bufs = append(bufs,string(p.Buf))
+		default: return
+		}
+	}
+}
+
+/*
+The fate of the packets on one link only depends on the seed and the names of both
+ends, not on the traffic of other links.
+*/
+func TestLinkRandomness(t *testing.T) {
+	run := func(noise bool) []string {
+		n := NewNetwork(7)
+		n.SetManual(true)
+		n.SetLoss(0.5)
+		a,b,c := n.NewTransport("a"),n.NewTransport("b"),n.NewTransport("c")
+		for i := 0; i<64; i++ {
+			if noise { c.WriteTo([]byte("noise"),b.Addr()) }
+			a.WriteTo([]byte{byte(i)},b.Addr())
+		}
+		n.Advance(time.Second)
+		var got []string
+		for _,s := range drain(b) {
+			if s!="noise" { got = append(got,s) }
+		}
+		return got
+	}
+	x,y := run(false),run(true)
+	if len(x)==0 || len(x)==64 { t.Fatalf("loss 0.5 delivered %d of 64 packets",len(x)) }
+	if len(x)!=len(y) { t.Fatalf("other traffic changed the link: %d vs %d packets",len(x),len(y)) }
+	for i := range x {
+		if x[i]!=y[i] { t.Fatalf("packet %d differs",i) }
+	}
+}
+
+func TestManualStep(t *testing.T) {
+	n := NewNetwork(1)
+	n.SetManual(true)
+	start := n.Now()
+	a,b := n.NewTransport("a"),n.NewTransport("b")
+	
+	n.SetLatency(time.Millisecond*30,0)
+	a.WriteTo([]byte("slow"),b.Addr())
+	n.SetLatency(time.Millisecond*10,0)
+	a.WriteTo([]byte("fast"),b.Addr())
+	a.WriteTo([]byte("fast2"),b.Addr())
+	
+	if p := n.Pending(); p!=3 { t.Fatalf("pending = %d, want 3",p) }
+	time.Sleep(time.Millisecond*50)
+	if got := drain(b); len(got)!=0 { t.Fatalf("delivered without a step: %v",got) }
+	
+	if !n.Step() { t.Fatal("step found no packet") }
+	if got := drain(b); len(got)!=1 || got[0]!="fast" { t.Fatalf("first step delivered %v",got) }
+	if now := n.Now()-start; now!=time.Millisecond*10 { t.Fatalf("clock = %v after the first step",now) }
+	
+	if c := n.Advance(time.Millisecond*5); c!=1 { t.Fatalf("advance delivered %d packets, want 1",c) }
+	if got := drain(b); len(got)!=1 || got[0]!="fast2" { t.Fatalf("advance delivered %v",got) }
+	
+	n.Advance(time.Millisecond*15)
+	if got := drain(b); len(got)!=1 || got[0]!="slow" { t.Fatalf("advance delivered %v",got) }
+	if n.Step() { t.Fatal("step delivered a packet from an empty queue") }
+}
+
+func TestAutoDelivery(t *testing.T) {
+	n := NewNetwork(1)
+	a,b := n.NewTransport("a"),n.NewTransport("b")
+	n.SetLatency(time.Millisecond*5,time.Millisecond*5)
+	for i := 0; i<10; i++ { a.WriteTo([]byte{byte(i)},b.Addr()) }
+	for i := 0; i<10; i++ {
+		select {
+		case <-b.PacketCh():
+		case <-time.After(time.Second): t.Fatalf("packet %d not delivered",i)
+		}
+	}
+}
+
+func TestPartitionClosesStreams(t *testing.T) {
+	n := NewNetwork(1)
+	a,b := n.NewTransport("a"),n.NewTransport("b")
+	conn,err := a.DialTimeout(b.Addr(),time.Second)
+	if err!=nil { t.Fatal(err) }
+	peer := <-b.StreamCh()
+	if peer.RemoteAddr().String()!=a.Addr() { t.Fatalf("remote address %v, want %v",peer.RemoteAddr(),a.Addr()) }
+	
+	n.Partition([]string{"a"},[]string{"b"})
+	if _,err := conn.Write([]byte("x")); err==nil { t.Fatal("write on a cut stream succeeded") }
+	if _,err := peer.Read(make([]byte,1)); err==nil { t.Fatal("read on a cut stream succeeded") }
+	
+	if _,err := a.DialTimeout(b.Addr(),time.Millisecond*10); err==nil { t.Fatal("dial across a partition succeeded") }
+	if _,err := a.WriteTo([]byte("x"),b.Addr()); err!=nil { t.Fatal(err) }
+	time.Sleep(time.Millisecond*10)
+	if got := drain(b); len(got)!=0 { t.Fatalf("packet crossed the partition: %v",got) }
+}
+
+/*
+Shortens the timeouts of memberlist, so failures are detected quickly.
+*/
+func fast(i int, wn *mlst.WrapNode, cfg *memberlist.Config) {
+	cfg.ProbeInterval = time.Millisecond*100
+	cfg.ProbeTimeout = time.Millisecond*50
+	cfg.GossipInterval = time.Millisecond*20
+	cfg.SuspicionMult = 1
+}
+
+func TestClusterKill(t *testing.T) {
+	c,err := NewCluster(NewNetwork(1),3,fast)
+	if err!=nil { t.Fatal(err) }
+	defer c.Shutdown()
+	if err = c.WaitMembers(3,time.Second*5); err!=nil { t.Fatal(err) }
+	
+	c.Kill(2)
+	if err = c.WaitMembers(2,time.Second*10); err!=nil { t.Fatal(err) }
+}
+
+func TestClusterPartition(t *testing.T) {
+	c,err := NewCluster(NewNetwork(1),3,fast)
+	if err!=nil { t.Fatal(err) }
+	defer c.Shutdown()
+	if err = c.WaitMembers(3,time.Second*5); err!=nil { t.Fatal(err) }
+	
+	c.Net.Partition([]string{"node-0","node-1"},[]string{"node-2"})
+	deadline := time.Now().Add(time.Second*10)
+	for c.Lists[0].NumMembers()!=2 || c.Lists[2].NumMembers()!=1 {
+		if time.Now().After(deadline) { t.Fatal("the partition was not detected") }
+		time.Sleep(time.Millisecond*10)
+	}
+}
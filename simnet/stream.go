@@ -0,0 +1,82 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package simnet
+
+import (
+	"net"
+)
+
+/*
+A stream connection between two transports. Both ends are net.Pipe ends, that report
+the simulated addresses.
+*/
+type stream struct{
+	net  *Network
+	a, b string // The names of the dialing and the accepting node.
+	
+	dial, accept *streamConn
+}
+
+type streamConn struct{
+	net.Conn
+	st            *stream
+	local, remote Addr
+}
+
+func (c *streamConn) LocalAddr() net.Addr { return c.local }
+func (c *streamConn) RemoteAddr() net.Addr { return c.remote }
+
+/*
+Closes this end. The other end reads EOF.
+*/
+func (c *streamConn) Close() error {
+	c.st.forget()
+	return c.Conn.Close()
+}
+
+func (n *Network) newStream(from, to *Transport) *stream {
+	p1,p2 := net.Pipe()
+	st := &stream{net:n,a:from.name,b:to.name}
+	st.dial = &streamConn{p1,st,from.addr,to.addr}
+	st.accept = &streamConn{p2,st,to.addr,from.addr}
+	n.lck.Lock()
+	n.streams[st] = true
+	n.lck.Unlock()
+	return st
+}
+
+func (st *stream) forget() {
+	st.net.lck.Lock()
+	delete(st.net.streams,st)
+	st.net.lck.Unlock()
+}
+
+/*
+Closes both ends, like a network failure.
+*/
+func (st *stream) close() {
+	st.forget()
+	st.dial.Conn.Close()
+	st.accept.Conn.Close()
+}
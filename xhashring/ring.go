@@ -24,6 +24,7 @@ SOFTWARE.
 package xhashring
 
 import (
+	"github.com/byte-mug/cherdy/mlst"
 	"github.com/byte-mug/golibs/chordhash"
 	avl "github.com/emirpasic/gods/trees/avltree"
 	"github.com/byte-mug/golibs/concurrent/sortlist"
@@ -73,6 +74,8 @@ func (e *Entry) testDeath(cur time.Time) bool {
 type Table struct{
 	HashFunc func(string)string
 	
+	Log *mlst.Log // may be nil
+	
 	NodeDeath time.Duration
 	
 	index sortlist.Sortlist
@@ -91,25 +94,29 @@ func (t *Table) unlock() {
 	t.wg.Done()
 	t.lck.Unlock()
 }
+/*
+Logs all entries of the ring at debug level.
+*/
 func (t *Table) Debug_Dump() {
 	t.lck.Lock()
 	defer t.lck.Unlock()
-	
-	fmt.Println("{")
-	for n := t.ring.Tree.Left(); n!=nil; n = n.Next() {
-		//fmt.Printf("\t%x -> %q\n",n.Key,n.Value.(*Entry).Name)
-		fmt.Println("\t",n.Value)
-	}
-	fmt.Println("}")
+	t.dump()
 }
 
 func (t *Table) dump() {
-	fmt.Println("{")
+	t.Log.Debug("ring dump","size",t.ring.Tree.Size())
 	for n := t.ring.Tree.Left(); n!=nil; n = n.Next() {
-		//fmt.Printf("\t%x -> %q\n",n.Key,n.Value.(*Entry).Name)
-		fmt.Println("\t",n.Value)
+		t.Log.Debug("ring entry","name",n.Value.(*Entry).Name,"hash",fmt.Sprintf("%x",n.Key))
 	}
-	fmt.Println("}")
+}
+
+/*
+Returns the number of entries in the ring.
+*/
+func (t *Table) Size() int {
+	t.lck.Lock()
+	defer t.lck.Unlock()
+	return t.ring.Tree.Size()
 }
 
 func (t *Table) Init() {
@@ -175,6 +182,7 @@ func (t *Table) Join(name string) {
 	ent.join()
 	t.index.Insert(name,ent)
 	t.ring.Tree.Put(ent.Hash,ent)
+	t.Log.Info("ring member added","name",name,"size",t.ring.Tree.Size())
 }
 
 /*
@@ -200,6 +208,7 @@ func (t *Table) Invalidate(name string) {
 		defer t.unlock()
 		t.index.Delete(e.Name)
 		t.ring.Tree.Remove(e.Hash)
+		t.Log.Info("ring member removed","name",name,"size",t.ring.Tree.Size())
 	}
 }
 
@@ -251,6 +260,7 @@ func (t *Table) Cleanup() {
 	for _,e := range es {
 		t.index.Delete(e.Name)
 		t.ring.Tree.Remove(e.Hash)
+		t.Log.Info("ring member expired","name",e.Name,"size",t.ring.Tree.Size())
 	}
 }
 
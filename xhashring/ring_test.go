@@ -0,0 +1,74 @@
+/*
+Copyright (c) 2019 Simon Schmidt
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+
+package xhashring_test
+
+import (
+	"fmt"
+	"github.com/byte-mug/cherdy/db"
+	"github.com/byte-mug/cherdy/mlst"
+	"github.com/byte-mug/cherdy/simnet"
+	"github.com/byte-mug/cherdy/xhashring"
+	"github.com/hashicorp/memberlist"
+	"testing"
+	"time"
+)
+
+var _ db.Ring = (*xhashring.Subscriber)(nil)
+
+/*
+Once the ring has converged, all nodes agree on the owners, the range and the hashnum
+of every key.
+*/
+func TestRingAgreement(t *testing.T) {
+	var subs []*xhashring.Subscriber
+	c,err := simnet.NewCluster(simnet.NewNetwork(1),4,func(i int, wn *mlst.WrapNode, cfg *memberlist.Config) {
+		sub := &xhashring.Subscriber{Num:3}
+		sub.Tab.Init()
+		sub.Attach(wn)
+		xhashring.BecomeMember(wn)
+		subs = append(subs,sub)
+	})
+	if err!=nil { t.Fatal(err) }
+	defer c.Shutdown()
+	if err = c.WaitMembers(4,time.Second*5); err!=nil { t.Fatal(err) }
+	
+	describe := func(s *xhashring.Subscriber, key []byte) string {
+		rng,owners := s.KeyRange(key)
+		return fmt.Sprint(s.KeyOwners(key),rng,owners,s.KeyHashnum(key))
+	}
+	deadline := time.Now().Add(time.Second*5)
+	for {
+		agree := true
+		for i := 0; i<32 && agree; i++ {
+			key := []byte(fmt.Sprint("key",i))
+			want := describe(subs[0],key)
+			for _,s := range subs[1:] { agree = agree && describe(s,key)==want }
+			if n := len(subs[0].KeyOwners(key)); n!=3 { agree = false }
+			if subs[0].KeyHashnum(key)<0 { t.Fatalf("negative hashnum for %s",key) }
+		}
+		if agree { break }
+		if time.Now().After(deadline) { t.Fatal("the nodes don't agree on the ring") }
+		time.Sleep(time.Millisecond*50)
+	}
+}
@@ -24,15 +24,12 @@ SOFTWARE.
 package xhashring
 
 import (
-	"fmt"
 	"github.com/byte-mug/cherdy/mlst"
 	"github.com/hashicorp/memberlist"
 	"github.com/byte-mug/golibs/bufferex"
 	avl "github.com/emirpasic/gods/trees/avltree"
 )
 
-func debug(i ...interface{}) { fmt.Println(i...) }
-
 const (
 	MT_HashRingFlags = 0x20000 | iota
 )
@@ -46,6 +43,10 @@ const (
 	MH_HrRoute = 0x20000 + iota
 )
 
+func init() {
+	mlst.RegisterSchema(MH_HrRoute,mlst.Schema{Name:"MH_HrRoute",Fields:[]string{"flag","id"},Prefix:true})
+}
+
 /*
 Route-Flags
 */
@@ -63,7 +64,7 @@ type Subscriber struct{
 func (s *Subscriber) NotifyJoin(node *memberlist.Node) {
 	m := mlst.DecodeNodeMeta(node.Meta)
 	if m.HasFlags(MT_HashRingFlags,HRF_Member) {
-		fmt.Println("enter",node.Name)
+		s.Node.Log.Info("hashring node joined","name",node.Name)
 		s.Tab.Join(node.Name)
 		//s.Tab.Debug_Dump()
 	} else {
@@ -81,7 +82,7 @@ func (s *Subscriber) NotifyUpdate(node *memberlist.Node) {
 }
 
 func (s *Subscriber) NotifyLeave(node *memberlist.Node) {
-	fmt.Println("leave",node.Name)
+	s.Node.Log.Info("hashring node left","name",node.Name)
 	s.Tab.Leave(node.Name)
 }
 
@@ -118,6 +119,62 @@ func (s *Subscriber) findLast(head *avl.Node) (n *memberlist.Node) {
 	return
 }
 
+/*
+Returns the names of the Num nodes, that own the ring position id, including nodes,
+that are currently dead.
+*/
+func (s *Subscriber) Owners(id string) (names []string) {
+	v := s.Tab.Next(id)
+	seen := make(map[string]bool)
+	for i := s.Num; i>0 && v!=nil; i-- {
+		name := v.Value.(*Entry).Name
+		if seen[name] { break } // The ring is smaller than Num.
+		seen[name] = true
+		names = append(names,name)
+		v = s.Tab.Step(v)
+	}
+	return
+}
+
+/*
+Returns the owners of a key. The key is mapped onto the ring using Tab.HashFunc.
+*/
+func (s *Subscriber) KeyOwners(key []byte) []string {
+	return s.Owners(s.Tab.HashFunc(string(key)))
+}
+
+/*
+Returns the hashnum of a key for db.Store, derived from the ring position of the
+key. All nodes map a key onto the same hashnum.
+*/
+func (s *Subscriber) KeyHashnum(key []byte) int {
+	h := s.Tab.HashFunc(string(key))
+	var n uint32
+	for i := 0; i<4 && i<len(h); i++ { n = n<<8 | uint32(h[i]) }
+	return int(n&0x7fffffff)
+}
+
+/*
+Returns the ownership range of a key and it's owners. The range is identified by the
+name of the node, that ends it. All keys of a range have the same owners.
+*/
+func (s *Subscriber) KeyRange(key []byte) (id string, owners []string) {
+	h := s.Tab.HashFunc(string(key))
+	if v := s.Tab.Next(h); v!=nil { id = v.Value.(*Entry).Name }
+	return id,s.Owners(h)
+}
+
+/*
+Returns all alive members of the ring, e.g. for a scatter-gather request.
+*/
+func (s *Subscriber) Members() (ns []*memberlist.Node) {
+	s.Tab.lck.Lock()
+	defer s.Tab.lck.Unlock()
+	for v := s.Tab.ring.Tree.Left(); v!=nil; v = v.Next() {
+		if n := s.Node.Lookup(v.Value.(*Entry).Name); n!=nil { ns = append(ns,n) }
+	}
+	return
+}
 
 func (s *Subscriber) HrRoute(w *mlst.WrapNode, d *mlst.MessageReader, msg bufferex.Binary) bool {
 	flag,err := d.DecodeInt()
@@ -129,10 +186,16 @@ func (s *Subscriber) HrRoute(w *mlst.WrapNode, d *mlst.MessageReader, msg buffer
 	v := s.Tab.Next(id)
 	
 	// If there are no routable nodes, discard.
-	if v==nil { return false }
+	if v==nil {
+		w.Log.Debug("route discarded","reason","empty-ring","id",id)
+		return false
+	}
 	
 	// If this packet is for us, consume the rest of it.
-	if s.CheckSelf(v) { return true }
+	if s.CheckSelf(v) {
+		w.Log.Debug("route consumed","id",id)
+		return true
+	}
 	
 	var node *memberlist.Node
 	
@@ -144,24 +207,46 @@ func (s *Subscriber) HrRoute(w *mlst.WrapNode, d *mlst.MessageReader, msg buffer
 	}
 	
 	// If ther is no alive node, we cannot forward this message.
-	if node==nil { return false }
+	if node==nil {
+		w.Log.Debug("route discarded","reason","no-alive-node","id",id)
+		return false
+	}
 	
-	mb := new(mlst.MessageBuffer).Init()
+	// If the sender has already given up, don't forward.
+	if d.Context().Err()!=nil {
+		w.Log.Debug("route discarded","reason","deadline","id",id)
+		return false
+	}
+	
+	sp := w.Tracer.Start(d,"hr-route forward")
+	if sp!=nil { sp.SetAttr("to",node.Name) }
+	defer sp.Finish()
+	
+	mb := w.NewMessage()
 	
 	// Rewrite the header.
+	mb.EncodeEnvelope(d)
 	mb.EncodeMulti(MH_HrRoute,flag,id)
 	
 	// Append the rest of the packet.
 	d.WriteTo(mb)
 	
 	// Forward the packet to the other node.
-	s.Node.SendTo(mlst.ST_BestFit,node,mb.Bytes())
+	w.Log.Debug("route forwarded","id",id,"to",node.Name)
+	if err := s.Node.SendTo(mlst.ST_BestFit,node,mb.Bytes()); err!=nil {
+		w.Log.Warn("route forward failed","id",id,"to",node.Name,"err",err)
+		if sp!=nil { sp.SetAttr("error",err.Error()) }
+	}
 	
 	return false
 }
 
 func (s *Subscriber) Attach(wn *mlst.WrapNode) {
 	s.Node = wn
+	s.Tab.Log = &wn.Log
+	wn.Metrics.GaugeFunc("cherdy_hashring_size","Number of nodes in the hash ring.",func() float64 {
+		return float64(s.Tab.Size())
+	})
 	wn.Deleg.AsyncHooks = append(wn.Deleg.AsyncHooks,s)
 	wn.Handlers[MH_HrRoute] = s.HrRoute
 	wn.Meta[MT_HashRingFlags] |= HRF_Subscriber